@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"time"
 
 	"github.com/jstol/digital-ocean-autoscaler/autoscaler/master"
@@ -16,9 +18,13 @@ func main() {
 	command := flag.String("command", "", "the command to run after writing out the load balancer's new configuration file")
 	balanceConfigTemplate := flag.String("balancetemplate", "", "the load balancer config file template to use")
 	balanceConfigFile := flag.String("balanceconfig", "", "the load balancer config file to write to")
+	balanceCheckCommand := flag.String("checkcommand", "", "the command to validate a new load balancer config file with, e.g. 'haproxy -c -f {file}' (overrides the worker config)")
 	workerConfigFile := flag.String("workerconfig", "", "the worker config file (JSON) to read from")
 	digitalOceanToken := flag.String("token", "", "the Digital Ocean API token to use")
-	digitalOceanImageID := flag.String("image", "", "the ID of the image to use when creating worker nodes")
+	digitalOceanAPIURL := flag.String("apiurl", "", "the base URL of the Digital Ocean API (e.g. a local fake API server)")
+	digitalOceanImageID := flag.String("image", "", "the slug or snapshot ID of the image to use when creating worker nodes (overrides the worker config)")
+	haproxySocket := flag.String("haproxysocket", "", "the HAProxy runtime API address, a UNIX socket path or tcp://host:port (overrides the worker config)")
+	haproxyBackend := flag.String("haproxybackend", "", "the HAProxy backend the workers are servers in (overrides the worker config)")
 	overloadedCpuThreshold := flag.Float64("overloaded", 0.7, "the average CPU usage threshold after which the nodes are considered overloaded")
 	underusedCpuThreshold := flag.Float64("underused", 0.3, "the CPU usage threshold to consider a node as underutilized")
 	minWorkers := flag.Int64("min", 1, "the minimum number of workers to have")
@@ -31,43 +37,51 @@ func main() {
 	cooldownInterval := flag.Int64("cooldowninterval", 15, "the amount of time (in seconds) to wait before making changes to workers after altering the worker set")
 	surveyDeadline := flag.Int64("surveydeadline", 1, "the amount of time (in seconds) to wait to receive feedback from workers")
 	queryInterval := flag.Int64("surveytimeout", 3, "the amount of time (in seconds) to leave between querying workers")
+	retries := flag.Int("retries", 5, "the number of attempts to make for each Digital Ocean API call")
+	retryBackoff := flag.Int64("retrybackoff", 1, "the amount of time (in seconds) to wait before retrying a failed API call (doubled on each attempt)")
+	retryMaxBackoff := flag.Int64("retrymaxbackoff", 30, "the maximum amount of time (in seconds) to wait between retries of a failed API call")
+	apiAddr := flag.String("apiaddr", "", "the IP address and port to serve the HTTP control API on (disabled if empty)")
+	apiToken := flag.String("apitoken", "", "the bearer token the control API requires (only optional on a loopback address)")
 	changeWeights := flag.Bool("weights", true, "whether or not to use weights")
 	scaleNodes := flag.Bool("autoscale", true, "whether or not to scale nodes up and down")
 	flag.Parse()
 
 	// Handle checking command line arguments
-	if *command == "" {
-		utils.Die("Missing -command flag")
-	} else if *balanceConfigTemplate == "" {
-		utils.Die("Missing -balancetemplate flag")
-	} else if *balanceConfigFile == "" {
-		utils.Die("Missing -balanceconfig flag")
-	} else if *workerConfigFile == "" {
+	if *workerConfigFile == "" {
 		utils.Die("Missing -workerconfig flag")
 	} else if *digitalOceanToken == "" {
 		utils.Die("Missing -token flag")
-	} else if *digitalOceanImageID == "" {
-		utils.Die("Missing -image flag")
 	} else if *minWorkers <= 0 {
 		utils.Die("The -min must be non-negative")
 	} else if *maxWorkers <= 0 {
 		utils.Die("The -max must be non-negative")
 	} else if *maxWorkers < *minWorkers {
 		utils.Die("Max number of workers must be greater than or equal to the min")
+	} else if *retries <= 0 {
+		utils.Die("The -retries must be positive")
 	} else if *streamStatsd && *statsdAddr == "" {
 		utils.Die("Statsd streaming requested, but missing -statsdaddr flag")
+	} else if *apiAddr != "" && *apiToken == "" && !isLoopback(*apiAddr) {
+		// The control API can launch and delete droplets, so only this machine may use it unauthenticated
+		utils.Die("Missing -apitoken flag: it's required to serve the control API on %s, which isn't a loopback address", *apiAddr)
 	}
 
 	// Read in the config file
-	var workerConfig master.WorkerConfig
+	var config master.Config
 
 	jsonData, err := ioutil.ReadFile(*workerConfigFile)
 	if err != nil {
 		utils.Die("Error reading in config file: %s", err.Error())
 	}
-	if err = json.Unmarshal(jsonData, &workerConfig); err != nil {
+	if err = json.Unmarshal(jsonData, &config); err != nil {
 		utils.Die("Error parsing JSON in config file: %s", err.Error())
 	}
+	pools, err := config.PoolConfigs()
+	if err != nil {
+		utils.Die("Invalid worker config: %s", err.Error())
+	}
+	// Flags naming one pool's settings only override a config without named pools
+	singlePool := len(config.Pools) == 0
 
 	if !*changeWeights {
 		fmt.Println("NOT CHANGING WEIGHTS")
@@ -78,37 +92,154 @@ func main() {
 
 	// Start the master
 	fmt.Printf("Starting master at %s\n", *host)
-	var monitor *master.Master
-
-	if !*streamStatsd {
-		monitor = master.NewMaster(
-			*host,
-			&workerConfig,
-			*command,
-			*balanceConfigTemplate, *balanceConfigFile,
-			*digitalOceanToken, *digitalOceanImageID,
-			*overloadedCpuThreshold, *underusedCpuThreshold,
-			*minWorkers, *maxWorkers,
-			time.Duration(*pollInterval)*time.Second, time.Duration(*cooldownInterval)*time.Second,
-			time.Duration(*surveyDeadline)*time.Second, time.Duration(*queryInterval)*time.Second,
-			*scaleNodes, *changeWeights,
-		)
-	} else {
-		monitor = master.NewMasterWithStatsd(
-			*host,
-			&workerConfig,
-			*command,
-			*balanceConfigTemplate, *balanceConfigFile,
-			*digitalOceanToken, *digitalOceanImageID,
-			*overloadedCpuThreshold, *underusedCpuThreshold,
-			*minWorkers, *maxWorkers,
-			time.Duration(*pollInterval)*time.Second, time.Duration(*cooldownInterval)*time.Second,
-			time.Duration(*surveyDeadline)*time.Second, time.Duration(*queryInterval)*time.Second,
-			*scaleNodes, *changeWeights,
-			*statsdAddr, *statsdPrefix, time.Duration(*statsdInterval)*time.Second,
-		)
+	digitalOcean := master.NewDigitalOceanProvider(*digitalOceanToken)
+	if *digitalOceanAPIURL != "" {
+		if err = digitalOcean.SetBaseURL(*digitalOceanAPIURL); err != nil {
+			utils.Die("Invalid -apiurl: %s", err.Error())
+		}
+	}
+	provider := master.NewRetryProvider(digitalOcean, master.RetryPolicy{
+		Attempts:       *retries,
+		InitialBackoff: time.Duration(*retryBackoff) * time.Second,
+		MaxBackoff:     time.Duration(*retryMaxBackoff) * time.Second,
+	})
+
+	var monitors []*master.Master
+	outputs := make(map[string]string)
+	for _, pool := range pools {
+		// The pool's own settings take the place of the flags
+		if pool.ConfigFile.Template == "" {
+			pool.ConfigFile.Template = *balanceConfigTemplate
+		}
+		if pool.ConfigFile.Output == "" {
+			pool.ConfigFile.Output = *balanceConfigFile
+		}
+		if pool.ConfigFile.Command == "" {
+			pool.ConfigFile.Command = *command
+		}
+		if pool.Min == 0 {
+			pool.Min = *minWorkers
+		}
+		if pool.Max == 0 {
+			pool.Max = *maxWorkers
+		}
+		if pool.Overloaded == 0 {
+			pool.Overloaded = *overloadedCpuThreshold
+		}
+		if pool.Underused == 0 {
+			pool.Underused = *underusedCpuThreshold
+		}
+		if pool.Cooldown == 0 {
+			pool.Cooldown = *cooldownInterval
+		}
+		if pool.Min <= 0 || pool.Max <= 0 {
+			utils.Die("The min and max of pool %s must be positive", pool.Name)
+		} else if pool.Max < pool.Min {
+			utils.Die("Max number of workers in pool %s must be greater than or equal to the min", pool.Name)
+		}
+
+		// HAProxy and nginx are configured through a config file, so they need the template and command
+		switch pool.LoadBalancer {
+		case "", "haproxy", "nginx":
+			if pool.ConfigFile.Command == "" {
+				utils.Die("Missing -command flag (or configFile.command for pool %s)", pool.Name)
+			} else if pool.ConfigFile.Template == "" {
+				utils.Die("Missing -balancetemplate flag (or configFile.template for pool %s)", pool.Name)
+			} else if pool.ConfigFile.Output == "" {
+				utils.Die("Missing -balanceconfig flag (or configFile.output for pool %s)", pool.Name)
+			}
+			if other, ok := outputs[pool.ConfigFile.Output]; ok {
+				utils.Die("Pools %s and %s both write %s", other, pool.Name, pool.ConfigFile.Output)
+			}
+			outputs[pool.ConfigFile.Output] = pool.Name
+		}
+
+		if *balanceCheckCommand != "" {
+			pool.ConfigFile.Check = *balanceCheckCommand
+		}
+		if *haproxySocket != "" {
+			pool.HAProxy.Socket = *haproxySocket
+		}
+		if *haproxyBackend != "" && singlePool {
+			pool.HAProxy.Backend = *haproxyBackend
+		}
+		imageID := *digitalOceanImageID
+		if !singlePool && pool.Launch.HasImage() {
+			imageID = ""
+		}
+		if imageID == "" && !pool.Launch.HasImage() {
+			utils.Die("Missing -image flag (or launch image for pool %s)", pool.Name)
+		}
+
+		// Each pool's stats go under its own prefix
+		prefix := *statsdPrefix
+		if !singlePool {
+			prefix = fmt.Sprintf("%s%s.", *statsdPrefix, pool.Name)
+		}
+
+		var monitor *master.Master
+		if !*streamStatsd {
+			monitor, err = master.NewMaster(
+				*host,
+				pool,
+				provider,
+				pool.ConfigFile.Command,
+				pool.ConfigFile.Template, pool.ConfigFile.Output, imageID,
+				pool.Overloaded, pool.Underused,
+				pool.Min, pool.Max,
+				time.Duration(*pollInterval)*time.Second, time.Duration(pool.Cooldown)*time.Second,
+				*scaleNodes, *changeWeights,
+			)
+		} else {
+			monitor, err = master.NewMasterWithStatsd(
+				*host,
+				pool,
+				provider,
+				pool.ConfigFile.Command,
+				pool.ConfigFile.Template, pool.ConfigFile.Output, imageID,
+				pool.Overloaded, pool.Underused,
+				pool.Min, pool.Max,
+				time.Duration(*pollInterval)*time.Second, time.Duration(pool.Cooldown)*time.Second,
+				*scaleNodes, *changeWeights,
+				*statsdAddr, prefix, time.Duration(*statsdInterval)*time.Second,
+			)
+		}
+		if err != nil {
+			utils.Die("Error starting pool %s: %s", pool.Name, err.Error())
+		}
+		defer monitor.CleanUp()
+		monitors = append(monitors, monitor)
+	}
+
+	// Serve the control API alongside the pools
+	if *apiAddr != "" {
+		fmt.Printf("Serving control API at %s\n", *apiAddr)
+		go func() {
+			if err := http.ListenAndServe(*apiAddr, master.NewAPIServer(*apiToken, monitors...)); err != nil {
+				utils.Die("Error serving control API: %s", err.Error())
+			}
+		}()
 	}
-	defer monitor.CleanUp()
 
-	monitor.MonitorWorkers()
+	// All of the pools share the survey socket
+	surveyor, err := master.NewSurveyor(*host, time.Duration(*surveyDeadline)*time.Second, time.Duration(*queryInterval)*time.Second, monitors...)
+	if err != nil {
+		utils.Die("Error starting master: %s", err.Error())
+	}
+	if err = surveyor.Run(); err != nil {
+		utils.Die("Error monitoring workers: %s", err.Error())
+	}
+}
+
+// Whether an address only accepts connections from this machine
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestIsLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:9000": true,
+		"localhost:9000": true,
+		"[::1]:9000":     true,
+		":9000":          false,
+		"0.0.0.0:9000":   false,
+		"10.0.0.5:9000":  false,
+		"example.com:80": false,
+		"127.0.0.1":      false,
+	} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("%s loopback %t, want %t", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package master
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTP/JSON control API for the master's pools. Routes, all under /pools:
+//
+//	GET  /pools                                   status of every pool
+//	GET  /pools/{pool}                            status of one pool
+//	GET  /pools/{pool}/events                     recent worker events
+//	GET  /pools/{pool}/history                    ?metric=m and &worker=w or &aggregation=a
+//	POST /pools/{pool}/capacity                   {"min": 2, "max": 10, "desired": 4}; "desired": null clears it
+//	POST /pools/{pool}/scaling/{pause,resume}     turn autoscaling off or on
+//	POST /pools/{pool}/weights/{pause,resume}     turn weight updates off or on
+//	POST /pools/{pool}/scale-out                  {"count": 1}
+//	POST /pools/{pool}/scale-in                   {"count": 1}
+//	POST /pools/{pool}/workers/{name}/cordon      take a worker out of rotation
+//	POST /pools/{pool}/workers/{name}/uncordon    put it back
+//	POST /pools/{pool}/workers/{name}/drain       drain a worker and remove it
+//	POST /pools/{pool}/reload                     hand the workers to the load balancer again
+type APIServer struct {
+	masters []*Master
+	pools   map[string]*Master
+	// Bearer token required on every request, if set
+	token string
+}
+
+func NewAPIServer(token string, masters ...*Master) *APIServer {
+	pools := make(map[string]*Master)
+	for _, m := range masters {
+		pools[m.name] = m
+	}
+	return &APIServer{masters, pools, token}
+}
+
+func (a *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		header := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(header, "Bearer ")
+		if given == header || subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid token"))
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "pools" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+		return
+	}
+	if len(parts) == 1 {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		a.listPools(w)
+		return
+	}
+
+	m, ok := a.pools[parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pool named %s", parts[1]))
+		return
+	}
+	a.servePool(w, r, m, parts[2:])
+}
+
+func (a *APIServer) listPools(w http.ResponseWriter) {
+	statuses := []PoolStatus{}
+	for _, m := range a.masters {
+		status, err := m.Status()
+		if err != nil {
+			writeResult(w, err, nil)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (a *APIServer) servePool(w http.ResponseWriter, r *http.Request, m *Master, route []string) {
+	if len(route) == 0 {
+		if allowMethod(w, r, "GET") {
+			status, err := m.Status()
+			writeResult(w, err, status)
+		}
+		return
+	}
+	if route[0] == "events" && len(route) == 1 {
+		if allowMethod(w, r, "GET") {
+			writeJSON(w, http.StatusOK, m.Events())
+		}
+		return
+	}
+
+	if route[0] == "history" && len(route) == 1 {
+		if allowMethod(w, r, "GET") {
+			query := r.URL.Query()
+			datapoints, err := m.History(query.Get("metric"), query.Get("worker"), query.Get("aggregation"))
+			writeResult(w, err, datapoints)
+		}
+		return
+	}
+
+	// Everything else changes the pool
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+
+	var err error
+	switch {
+	case len(route) == 1 && route[0] == "capacity":
+		var update CapacityUpdate
+		if update, err = decodeCapacity(r); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = m.SetCapacity(update)
+
+	case len(route) == 2 && route[0] == "scaling" && (route[1] == "pause" || route[1] == "resume"):
+		err = m.SetScaling(route[1] == "resume")
+
+	case len(route) == 2 && route[0] == "weights" && (route[1] == "pause" || route[1] == "resume"):
+		err = m.SetWeightUpdates(route[1] == "resume")
+
+	case len(route) == 1 && (route[0] == "scale-out" || route[0] == "scale-in"):
+		var body struct {
+			Count int64 `json:"count"`
+		}
+		body.Count = 1
+		if err = decodeBody(r, &body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if route[0] == "scale-out" {
+			err = m.ScaleOut(body.Count)
+		} else {
+			err = m.ScaleIn(body.Count)
+		}
+
+	case len(route) == 3 && route[0] == "workers":
+		switch route[2] {
+		case "cordon":
+			err = m.Cordon(route[1])
+		case "uncordon":
+			err = m.Uncordon(route[1])
+		case "drain":
+			err = m.Drain(route[1])
+		default:
+			writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+			return
+		}
+
+	case len(route) == 1 && route[0] == "reload":
+		err = m.Reload()
+
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+		return
+	}
+
+	writeResult(w, err, map[string]string{"status": "ok"})
+}
+
+// Read a capacity change. An explicit "desired": null clears the desired capacity
+func decodeCapacity(r *http.Request) (CapacityUpdate, error) {
+	var body struct {
+		Min     *int64          `json:"min"`
+		Max     *int64          `json:"max"`
+		Desired json.RawMessage `json:"desired"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return CapacityUpdate{}, err
+	}
+
+	update := CapacityUpdate{Min: body.Min, Max: body.Max}
+	if bytes.Equal(bytes.TrimSpace(body.Desired), []byte("null")) {
+		update.ClearDesired = true
+	} else if len(body.Desired) > 0 {
+		var desired int64
+		if err := json.Unmarshal(body.Desired, &desired); err != nil {
+			return CapacityUpdate{}, fmt.Errorf("invalid desired capacity: %s", err)
+		}
+		update.Desired = &desired
+	}
+	return update, nil
+}
+
+// Decode a JSON request body into v. An empty body leaves v as it is
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(v); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid request body: %s", err)
+	}
+	return nil
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed, use %s", r.Method, method))
+		return false
+	}
+	return true
+}
+
+// Write the result of a request, mapping errors to status codes
+func writeResult(w http.ResponseWriter, err error, result interface{}) {
+	switch err.(type) {
+	case nil:
+		writeJSON(w, http.StatusOK, result)
+	case *NotFoundError:
+		writeError(w, http.StatusNotFound, err)
+	case *ConflictError:
+		writeError(w, http.StatusConflict, err)
+	case *RequestError:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Error writing API response: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,147 @@
+package master
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Carry out control requests the way the monitor loop does, until stopped
+func serveCommands(m *Master) func() {
+	stop := make(chan bool)
+	go func() {
+		created := make(chan workerChange, 10)
+		drained := make(chan drainResult, 10)
+		for {
+			select {
+			case request := <-m.commands:
+				request.done <- request.apply(loopChannels{created, drained})
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func apiRequest(api *APIServer, method, path, authorization string) int {
+	request := httptest.NewRequest(method, path, nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestAPIToken(t *testing.T) {
+	m, _ := newTestMaster(t, newFakeProvider(), &WorkerConfig{Name: "web", NamePrefix: "web"})
+	api := NewAPIServer("secret", m)
+
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := apiRequest(api, "GET", "/pools/web/events", test.authorization); code != test.want {
+			t.Errorf("Authorization %q: status %d, want %d", test.authorization, code, test.want)
+		}
+	}
+}
+
+func TestCordon(t *testing.T) {
+	provider := newFakeProvider()
+	m, loadBalancer := newTestMaster(t, provider, &WorkerConfig{Name: "web", NamePrefix: "web"})
+	worker := newWorker(provider.add("web-1", InstanceActive, time.Hour), provider)
+	m.workers = append(m.workers, worker)
+	defer serveCommands(m)()
+	api := NewAPIServer("", m)
+
+	// A worker the load balancer couldn't drain is still in rotation, so it isn't cordoned
+	loadBalancer.drainFailures = 1
+	if code := apiRequest(api, "POST", "/pools/web/workers/web-1/cordon", ""); code != http.StatusInternalServerError {
+		t.Errorf("cordon with a failing drain: status %d", code)
+	}
+	if worker.cordoned {
+		t.Error("worker marked cordoned although its drain failed")
+	}
+
+	// Likewise a worker the load balancer couldn't undrain stays cordoned, and can be retried
+	steps := []struct {
+		action          string
+		undrainFailures int
+		want            int
+		wantCordoned    bool
+	}{
+		{"cordon", 0, http.StatusOK, true},
+		{"cordon", 0, http.StatusConflict, true},
+		{"uncordon", 1, http.StatusInternalServerError, true},
+		{"uncordon", 0, http.StatusOK, false},
+		{"uncordon", 0, http.StatusConflict, false},
+	}
+	for _, step := range steps {
+		loadBalancer.undrainFailures = step.undrainFailures
+		if code := apiRequest(api, "POST", "/pools/web/workers/web-1/"+step.action, ""); code != step.want {
+			t.Errorf("%s: status %d, want %d", step.action, code, step.want)
+		}
+		m.lock.RLock()
+		if worker.cordoned != step.wantCordoned {
+			t.Errorf("%s: cordoned %t, want %t", step.action, worker.cordoned, step.wantCordoned)
+		}
+		m.lock.RUnlock()
+	}
+	if len(loadBalancer.drained) != 0 {
+		t.Errorf("%v still drained after uncordoning", loadBalancer.drained)
+	}
+}
+
+func TestManualScalingFollowsSchedule(t *testing.T) {
+	provider := newFakeProvider()
+	max, min := int64(2), int64(2)
+	m, _ := newTestMaster(t, provider, &WorkerConfig{
+		Name:       "web",
+		NamePrefix: "web",
+		Schedule:   []ScheduledAction{{Name: "quiet", Cron: "* * * * *", Min: &min, Max: &max}},
+	})
+	for _, name := range []string{"web-1", "web-2"} {
+		m.workers = append(m.workers, newWorker(provider.add(name, InstanceActive, time.Hour), provider))
+	}
+	defer serveCommands(m)()
+
+	// The configured bounds are 1 to 5, but the schedule holds the pool at 2
+	if err := m.ScaleOut(1); err == nil {
+		t.Error("scaled out over the scheduled max")
+	}
+	if err := m.ScaleIn(1); err == nil {
+		t.Error("scaled in under the scheduled min")
+	}
+	if created := provider.createdCount(); created != 0 {
+		t.Errorf("launched %d workers", created)
+	}
+}
+
+func TestReload(t *testing.T) {
+	provider := newFakeProvider()
+	m, loadBalancer := newTestMaster(t, provider, &WorkerConfig{Name: "web", NamePrefix: "web"})
+	for _, name := range []string{"web-1", "web-2"} {
+		m.workers = append(m.workers, newWorker(provider.add(name, InstanceActive, time.Hour), provider))
+	}
+	defer serveCommands(m)()
+
+	// Load balancers without a config file are reloaded too
+	if code := apiRequest(NewAPIServer("", m), "POST", "/pools/web/reload", ""); code != http.StatusOK {
+		t.Fatalf("reload: status %d", code)
+	}
+	loadBalancer.lock.Lock()
+	defer loadBalancer.lock.Unlock()
+	if len(loadBalancer.servers) != 2 {
+		t.Errorf("load balancer has %v, want both workers", loadBalancer.servers)
+	}
+}
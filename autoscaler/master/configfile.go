@@ -0,0 +1,350 @@
+package master
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultConfigVersions = 5
+	defaultListenPort     = 80
+
+	// Replaced with the path of the new config in the check command
+	checkFilePlaceholder = "{file}"
+)
+
+// How the load balancer config file is rendered, checked and versioned
+type ConfigFileConfig struct {
+	// The pool's own template, config file and reload command, in place of the -balancetemplate,
+	// -balanceconfig and -command flags
+	Template string `json:"template"`
+	Output   string `json:"output"`
+	Command  string `json:"command"`
+	// Command that validates a new config before it's moved into place, e.g. "haproxy -c -f {file}".
+	// {file} is replaced with the new config's path, quoted for the shell. Without it the path is
+	// added to the end
+	Check string `json:"check"`
+	// Number of previous versions to keep next to the config as <file>.1, <file>.2 and so on.
+	// Defaults to 5, negative keeps none
+	Versions int `json:"versions"`
+	// More files to render alongside the main config, e.g. HAProxy map files
+	Templates []TemplateOutput `json:"templates"`
+	// Port the load balancer serves the pool on, for templates. Defaults to 80
+	ListenPort int `json:"listenPort"`
+}
+
+// A template and the file it's rendered to
+type TemplateOutput struct {
+	Template string `json:"template"`
+	Output   string `json:"output"`
+	// Command that validates the new file, like the main config's check
+	Check string `json:"check"`
+}
+
+// What the load balancer config templates are given
+type TemplateData struct {
+	// Every worker, ordered by name
+	Servers []BackendServer
+	Fleet   FleetInfo
+}
+
+// The pool as a whole, for templates
+type FleetInfo struct {
+	Pool         string
+	NamePrefix   string
+	Tag          string
+	LoadBalancer string
+	// HAProxy backend or nginx upstream the workers go in, the port they serve on and the port
+	// the load balancer serves the pool on
+	Backend    string
+	Port       int
+	ListenPort int
+	// Number of workers, and how many of them are being drained
+	Workers, Draining int64
+	Min, Max          int64
+	LoadAvg           float64
+	// When the config was rendered
+	Generated time.Time
+}
+
+// Load balancer config files rendered from templates, and the command that makes the load
+// balancer pick them up. New configs are rendered to temporary files, checked and renamed into
+// place, so the live config is never left half written. If the load balancer won't reload with a
+// new config, the previous version is put back
+type configFile struct {
+	// The main config comes first
+	outputs  []*configOutput
+	command  string
+	versions int
+	// Fills in the fleet section of the template data, if set
+	fleet func() FleetInfo
+}
+
+type configOutput struct {
+	template    *template.Template
+	path, check string
+}
+
+func newConfigFile(templatePath, path, command string, config ConfigFileConfig) (*configFile, error) {
+	versions := config.Versions
+	if versions == 0 {
+		versions = defaultConfigVersions
+	} else if versions < 0 {
+		versions = 0
+	}
+
+	f := &configFile{command: command, versions: versions}
+	outputs := append([]TemplateOutput{{templatePath, path, config.Check}}, config.Templates...)
+	for _, output := range outputs {
+		if output.Template == "" || output.Output == "" {
+			return nil, fmt.Errorf("config templates need both a template and an output")
+		}
+
+		// Parse the templates once, up front
+		temp, err := template.New(filepath.Base(output.Template)).Funcs(templateFuncs()).ParseFiles(output.Template)
+		if err != nil {
+			return nil, fmt.Errorf("error reading in template %s: %s", output.Template, err)
+		}
+		f.outputs = append(f.outputs, &configOutput{temp, output.Output, output.Check})
+	}
+	return f, nil
+}
+
+// Render every template and put the results in place. Nothing is replaced unless every template
+// renders and passes its check. If one of the files can't be moved into place, the ones already
+// replaced are rolled back to their previous versions
+func (f *configFile) write(servers []BackendServer) error {
+	data := TemplateData{Servers: append([]BackendServer{}, servers...)}
+	sort.Sort(byServerName(data.Servers))
+	if f.fleet != nil {
+		data.Fleet = f.fleet()
+	}
+
+	// Print out all of the objects
+	fmt.Printf("Writing out new config for %d workers\n", len(data.Servers))
+	for _, server := range data.Servers {
+		fmt.Printf("%s: ip=%s, weight=%d, draining=%t\n", server.Name, server.Addr, server.Weight, server.Draining)
+	}
+
+	var temps []string
+	defer func() {
+		for _, tmp := range temps {
+			os.Remove(tmp)
+		}
+	}()
+
+	for _, output := range f.outputs {
+		var buffer bytes.Buffer
+		if err := output.template.Execute(&buffer, data); err != nil {
+			return fmt.Errorf("error executing template for %s: %s", output.path, err)
+		}
+
+		tmp, err := output.writeTemp(buffer.Bytes())
+		if tmp != "" {
+			temps = append(temps, tmp)
+		}
+		if err != nil {
+			return err
+		}
+		if err = output.validate(tmp); err != nil {
+			return err
+		}
+	}
+
+	for i, output := range f.outputs {
+		if err := output.replace(temps[i], f.versions); err != nil {
+			if rollbackErr := f.rollbackOutputs(f.outputs[:i]); rollbackErr != nil {
+				return fmt.Errorf("%s (couldn't roll back the files already replaced: %s)", err, rollbackErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Write new contents to a temporary file next to the output, returning its path
+func (o *configOutput) writeTemp(data []byte) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(o.path), "."+filepath.Base(o.path)+".")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary config file: %s", err)
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return tmp.Name(), fmt.Errorf("error writing temporary config file: %s", err)
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return tmp.Name(), fmt.Errorf("error setting permissions on temporary config file: %s", err)
+	}
+	return tmp.Name(), nil
+}
+
+// Run the check command against a new file
+func (o *configOutput) validate(path string) error {
+	if o.check == "" {
+		return nil
+	}
+
+	command := o.check
+	if strings.Contains(command, checkFilePlaceholder) {
+		command = strings.Replace(command, checkFilePlaceholder, shellQuote(path), -1)
+	} else {
+		command += " " + shellQuote(path)
+	}
+
+	if out, err := exec.Command("sh", "-c", command).CombinedOutput(); err != nil {
+		return fmt.Errorf("new %s failed its check: %s (output: '%s')", o.path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Quote a string as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Keep a copy of the current file and rename the checked temporary file over it
+func (o *configOutput) replace(tmp string, versions int) error {
+	if err := o.rotate(versions); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return fmt.Errorf("error moving %s into place: %s", o.path, err)
+	}
+	return nil
+}
+
+func (o *configOutput) version(n int) string {
+	return fmt.Sprintf("%s.%d", o.path, n)
+}
+
+// Shift the kept versions along by one and copy the current file to <file>.1. The current file
+// is copied rather than moved so it stays in place until the new one replaces it
+func (o *configOutput) rotate(versions int) error {
+	if versions == 0 {
+		return nil
+	}
+
+	current, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading current %s: %s", o.path, err)
+	}
+
+	for n := versions - 1; n >= 1; n-- {
+		if err = os.Rename(o.version(n), o.version(n+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error rotating versions of %s: %s", o.path, err)
+		}
+	}
+	if err = ioutil.WriteFile(o.version(1), current, 0644); err != nil {
+		return fmt.Errorf("error saving previous %s: %s", o.path, err)
+	}
+	return nil
+}
+
+// Put the previous version back in place, dropping it from the kept versions
+func (o *configOutput) rollback(versions int) error {
+	if versions == 0 {
+		return fmt.Errorf("no previous versions are kept")
+	}
+
+	previous, err := ioutil.ReadFile(o.version(1))
+	if err != nil {
+		return fmt.Errorf("error reading previous %s: %s", o.path, err)
+	}
+
+	// Skip the check and rotation: this file was live before
+	tmp := o.path + ".rollback"
+	if err = ioutil.WriteFile(tmp, previous, 0644); err != nil {
+		return fmt.Errorf("error writing previous %s: %s", o.path, err)
+	}
+	if err = os.Rename(tmp, o.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error moving previous %s into place: %s", o.path, err)
+	}
+
+	for n := 1; n < versions; n++ {
+		if err = os.Rename(o.version(n+1), o.version(n)); os.IsNotExist(err) {
+			os.Remove(o.version(n))
+			break
+		} else if err != nil {
+			return fmt.Errorf("error rotating versions of %s: %s", o.path, err)
+		}
+	}
+	if versions == 1 {
+		os.Remove(o.version(1))
+	}
+	return nil
+}
+
+// Put the previous version of every file back
+func (f *configFile) rollback() error {
+	return f.rollbackOutputs(f.outputs)
+}
+
+func (f *configFile) rollbackOutputs(outputs []*configOutput) error {
+	var errs []string
+	for _, output := range outputs {
+		if err := output.rollback(f.versions); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f *configFile) runCommand() error {
+	out, err := exec.Command("sh", "-c", f.command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error executing 'reload' command: %s (output: '%s')", err, strings.TrimSpace(string(out)))
+	}
+	fmt.Printf("Executed command. Output: '%s'\n", strings.TrimSpace(string(out)))
+	return nil
+}
+
+// Reload the load balancer. If it fails, roll back to the previous config and reload again
+func (f *configFile) reload() error {
+	err := f.runCommand()
+	if err == nil {
+		return nil
+	}
+
+	fmt.Printf("Reload failed, rolling back to the previous config: %s\n", err.Error())
+	if rollbackErr := f.rollback(); rollbackErr != nil {
+		return fmt.Errorf("%s (couldn't roll back: %s)", err, rollbackErr)
+	}
+	if reloadErr := f.runCommand(); reloadErr != nil {
+		return fmt.Errorf("%s (rolled back, but reloading the previous config failed too: %s)", err, reloadErr)
+	}
+	return fmt.Errorf("%s (rolled back to the previous config)", err)
+}
+
+// Write the config file and reload the load balancer
+func (f *configFile) apply(servers []BackendServer) error {
+	if err := f.write(servers); err != nil {
+		return err
+	}
+	return f.reload()
+}
+
+type byServerName []BackendServer
+
+func (s byServerName) Len() int           { return len(s) }
+func (s byServerName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byServerName) Less(i, j int) bool { return s[i].Name < s[j].Name }
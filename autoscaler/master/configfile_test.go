@@ -0,0 +1,79 @@
+package master
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigFileRollsBackPartialWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+	for name, contents := range map[string]string{
+		"main.tmpl":  "{{ range .Servers }}server {{ .Name }}\n{{ end }}",
+		"map.tmpl":   "{{ range .Servers }}{{ .Name }} {{ .Weight }}\n{{ end }}",
+		"main.cfg":   "server old\n",
+		"main.cfg.1": "server older\n",
+	} {
+		if err = ioutil.WriteFile(path(name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The map can't be replaced: its output is a directory
+	if err = os.MkdirAll(filepath.Join(path("map"), "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := newConfigFile(path("main.tmpl"), path("main.cfg"), "true", ConfigFileConfig{
+		Templates: []TemplateOutput{{Template: path("map.tmpl"), Output: path("map")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = file.write([]BackendServer{{Name: "web-1", Weight: 10}}); err == nil {
+		t.Fatal("no error writing over a directory")
+	}
+	for name, want := range map[string]string{"main.cfg": "server old\n", "main.cfg.1": "server older\n"} {
+		if got, _ := ioutil.ReadFile(path(name)); string(got) != want {
+			t.Errorf("%s is %q after the failed write, want %q", name, got, want)
+		}
+	}
+	if _, err = os.Stat(path("main.cfg.2")); !os.IsNotExist(err) {
+		t.Errorf("main.cfg.2 was left behind: %v", err)
+	}
+}
+
+func TestConfigFileCheckQuotesPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A path the shell would otherwise split, expand or choke on
+	dir = filepath.Join(dir, "lb configs's $HOME;")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	templatePath := filepath.Join(dir, "main.tmpl")
+	if err = ioutil.WriteFile(templatePath, []byte("{{ range .Servers }}server {{ .Name }}\n{{ end }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []string{"test -f {file}", "grep -q web-1"} {
+		file, err := newConfigFile(templatePath, filepath.Join(dir, "main.cfg"), "true", ConfigFileConfig{Check: check})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = file.write([]BackendServer{{Name: "web-1"}}); err != nil {
+			t.Errorf("'%s': %s", check, err)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How long a control request waits for the monitor loop to pick it up
+const controlTimeout = 10 * time.Second
+
+// Channels the monitor loop hands to control requests that start scaling actions
+type loopChannels struct {
+	created chan<- workerChange
+	drained chan<- drainResult
+}
+
+// A change requested through the control API. It's carried out by the monitor loop, so it can
+// touch the same state the loop does without further locking
+type controlRequest struct {
+	apply func(loop loopChannels) error
+	done  chan error
+}
+
+// Returned for requests that can't be carried out in the pool's current state, as opposed to
+// malformed ones
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+func conflict(format string, v ...interface{}) error {
+	return &ConflictError{fmt.Sprintf(format, v...)}
+}
+
+// Returned for requests with invalid values
+type RequestError struct {
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+func invalid(format string, v ...interface{}) error {
+	return &RequestError{fmt.Sprintf(format, v...)}
+}
+
+// Returned for workers and pools that don't exist
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+// Run a request on the monitor loop and wait for its result
+func (m *Master) control(apply func(loop loopChannels) error) error {
+	request := controlRequest{apply, make(chan error, 1)}
+	select {
+	case m.commands <- request:
+	case <-time.After(controlTimeout):
+		return fmt.Errorf("pool %s is busy, try again", m.name)
+	}
+	return <-request.done
+}
+
+// A worker as shown by the control API
+type WorkerStatus struct {
+	Name            string             `json:"name"`
+	ID              int                `json:"id"`
+	PublicAddr      string             `json:"publicAddr"`
+	PrivateAddr     string             `json:"privateAddr"`
+	Region          string             `json:"region"`
+	Size            string             `json:"size"`
+	Joined          time.Time          `json:"joined"`
+	LoadAvg         float64            `json:"loadAvg"`
+	Weight          int64              `json:"weight"`
+	Metrics         map[string]float64 `json:"metrics"`
+	LoadBalancer    *ServerStats       `json:"loadBalancer,omitempty"`
+	ProtocolVersion int                `json:"protocolVersion"`
+	Draining        bool               `json:"draining"`
+	Cordoned        bool               `json:"cordoned"`
+}
+
+// A worker being launched
+type PendingWorker struct {
+	Name  string    `json:"name"`
+	Since time.Time `json:"since"`
+}
+
+// The state of a pool as shown by the control API
+type PoolStatus struct {
+	Name    string          `json:"name"`
+	Workers []WorkerStatus  `json:"workers"`
+	Pending []PendingWorker `json:"pending"`
+	// Droplet IDs of the workers being drained and deleted
+	Removing        []int   `json:"removing"`
+	Min             int64   `json:"min"`
+	Max             int64   `json:"max"`
+	Desired         int64   `json:"desired"`
+	DesiredOverride *int64  `json:"desiredOverride,omitempty"`
+	LoadAvg         float64 `json:"loadAvg"`
+	Scaling         bool    `json:"scaling"`
+	Weights         bool    `json:"weights"`
+	CoolingDown     bool    `json:"coolingDown"`
+	Degraded        bool    `json:"degraded"`
+}
+
+func (m *Master) Status() (PoolStatus, error) {
+	var status PoolStatus
+	err := m.control(func(loop loopChannels) error {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+
+		status = PoolStatus{
+			Name:        m.name,
+			Workers:     []WorkerStatus{},
+			Pending:     []PendingWorker{},
+			Removing:    []int{},
+			Min:         m.minWorkers,
+			Max:         m.maxWorkers,
+			Desired:     m.lastDesired,
+			LoadAvg:     m.currentLoadAvg,
+			Scaling:     m.scaleNodes,
+			Weights:     m.changeWeights,
+			CoolingDown: m.coolingDown,
+			Degraded:    m.degraded,
+		}
+		if m.desiredOverride != nil {
+			desired := *m.desiredOverride
+			status.DesiredOverride = &desired
+		}
+
+		for _, worker := range m.workers {
+			status.Workers = append(status.Workers, WorkerStatus{
+				Name:            worker.instance.Name,
+				ID:              worker.instance.ID,
+				PublicAddr:      worker.publicAddr,
+				PrivateAddr:     worker.privateAddr,
+				Region:          worker.instance.Region,
+				Size:            worker.instance.Size,
+				Joined:          worker.joined,
+				LoadAvg:         worker.loadAvg,
+				Weight:          worker.weight,
+				Metrics:         worker.metrics,
+				LoadBalancer:    worker.lbStats,
+				ProtocolVersion: worker.protocolVersion,
+				Draining:        worker.draining,
+				Cordoned:        worker.cordoned,
+			})
+		}
+		for name, since := range m.pending {
+			status.Pending = append(status.Pending, PendingWorker{name, since})
+		}
+		sort.Sort(byPendingName(status.Pending))
+		for id := range m.removing {
+			status.Removing = append(status.Removing, id)
+		}
+		sort.Ints(status.Removing)
+		return nil
+	})
+	return status, err
+}
+
+type byPendingName []PendingWorker
+
+func (p byPendingName) Len() int           { return len(p) }
+func (p byPendingName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPendingName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+
+// Recorded values of a metric, either as reported by one worker or aggregated across the pool
+// ("mean" by default, "sum", "min", "max" or a percentile like "p95") at each survey
+func (m *Master) History(metric, worker, aggregation string) ([]Datapoint, error) {
+	if metric == "" {
+		return nil, invalid("metric is required")
+	}
+	if worker != "" {
+		return append([]Datapoint{}, m.history.Worker(worker, metric)...), nil
+	}
+	if _, err := aggregate(aggregation, []float64{0}); err != nil {
+		return nil, invalid("%s", err)
+	}
+	return append([]Datapoint{}, m.history.Fleet(metric, aggregation)...), nil
+}
+
+// Change to a pool's capacity. Fields left nil are unchanged
+type CapacityUpdate struct {
+	Min     *int64
+	Max     *int64
+	Desired *int64
+	// Go back to letting the policy and schedule decide the desired capacity
+	ClearDesired bool
+}
+
+func (m *Master) SetCapacity(update CapacityUpdate) error {
+	return m.control(func(loop loopChannels) error {
+		min, max := m.minWorkers, m.maxWorkers
+		if update.Min != nil {
+			min = *update.Min
+		}
+		if update.Max != nil {
+			max = *update.Max
+		}
+		if min <= 0 || max <= 0 {
+			return invalid("min and max must be positive")
+		} else if max < min {
+			return invalid("max must be greater than or equal to min")
+		}
+		if update.Desired != nil && (*update.Desired < min || *update.Desired > max) {
+			return invalid("desired must be between %d and %d", min, max)
+		}
+
+		m.lock.Lock()
+		m.minWorkers, m.maxWorkers = min, max
+		m.lock.Unlock()
+		if update.ClearDesired {
+			m.desiredOverride = nil
+		} else if update.Desired != nil {
+			desired := *update.Desired
+			m.desiredOverride = &desired
+		}
+
+		fmt.Printf("Pool %s capacity set to min %d, max %d\n", m.name, min, max)
+		return nil
+	})
+}
+
+// Turn autoscaling on or off
+func (m *Master) SetScaling(enabled bool) error {
+	return m.control(func(loop loopChannels) error {
+		m.scaleNodes = enabled
+		fmt.Printf("Pool %s scaling enabled: %t\n", m.name, enabled)
+		return nil
+	})
+}
+
+// Turn weight updates on or off
+func (m *Master) SetWeightUpdates(enabled bool) error {
+	return m.control(func(loop loopChannels) error {
+		m.lock.Lock()
+		m.changeWeights = enabled
+		m.lock.Unlock()
+		fmt.Printf("Pool %s weight updates enabled: %t\n", m.name, enabled)
+		return nil
+	})
+}
+
+// Launch workers now, up to the pool's max as the schedule leaves it. The policy still runs
+// afterwards, so unless scaling is paused or a desired capacity is set it may scale back in after
+// the cooldown
+func (m *Master) ScaleOut(count int64) error {
+	return m.control(func(loop loopChannels) error {
+		if count <= 0 {
+			return invalid("count must be positive")
+		}
+		_, maxWorkers, _ := m.schedule.Apply(time.Now(), m.minWorkers, m.maxWorkers)
+		if total := int64(len(m.workers)+len(m.pending)) + count; total > maxWorkers {
+			return conflict("scaling out by %d would take pool %s to %d workers, over its max of %d", count, m.name, total, maxWorkers)
+		}
+
+		fmt.Printf("Scaling out pool %s by %d (requested)\n", m.name, count)
+		m.lastScaleOut = time.Now()
+		return m.launchWorkers(count, loop.created)
+	})
+}
+
+// Drain and remove workers now, chosen the same way as when scaling in, down to the pool's min as
+// the schedule leaves it
+func (m *Master) ScaleIn(count int64) error {
+	return m.control(func(loop loopChannels) error {
+		if count <= 0 {
+			return invalid("count must be positive")
+		}
+		minWorkers, _, _ := m.schedule.Apply(time.Now(), m.minWorkers, m.maxWorkers)
+		if remaining := m.activeWorkers() - count; remaining < minWorkers {
+			return conflict("scaling in by %d would take pool %s to %d workers, under its min of %d", count, m.name, remaining, minWorkers)
+		}
+
+		fmt.Printf("Scaling in pool %s by %d (requested)\n", m.name, count)
+		for i := int64(0); i < count; i++ {
+			victim := m.selectVictim()
+			if victim == nil {
+				return conflict("only %d workers in pool %s could be removed", i, m.name)
+			}
+			m.startRemoving(victim, loop.drained)
+		}
+		return nil
+	})
+}
+
+// Number of workers that aren't being removed
+func (m *Master) activeWorkers() int64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var count int64
+	for _, worker := range m.workers {
+		if !worker.draining {
+			count++
+		}
+	}
+	return count
+}
+
+// Take a worker out of rotation without removing it. Cordoned workers get no weight updates and
+// are never picked when scaling in
+func (m *Master) Cordon(name string) error {
+	return m.control(func(loop loopChannels) error {
+		worker, err := m.namedWorker(name)
+		if err != nil {
+			return err
+		}
+		if worker.cordoned {
+			return conflict("%s is already cordoned", name)
+		}
+
+		// The worker only counts as cordoned once it's out of rotation
+		fmt.Printf("Cordoning %s\n", name)
+		if err = m.loadBalancer.Drain(name); err != nil {
+			return fmt.Errorf("couldn't take %s out of rotation: %s", name, err)
+		}
+		m.lock.Lock()
+		worker.cordoned = true
+		m.lock.Unlock()
+		return nil
+	})
+}
+
+// Put a cordoned worker back into rotation
+func (m *Master) Uncordon(name string) error {
+	return m.control(func(loop loopChannels) error {
+		worker, err := m.namedWorker(name)
+		if err != nil {
+			return err
+		}
+		if !worker.cordoned {
+			return conflict("%s isn't cordoned", name)
+		}
+
+		// The worker stays cordoned until it's back in rotation
+		fmt.Printf("Uncordoning %s\n", name)
+		if err = m.loadBalancer.Undrain(name); err != nil {
+			return fmt.Errorf("couldn't put %s back into rotation: %s", name, err)
+		}
+		m.lock.Lock()
+		worker.cordoned = false
+		m.lock.Unlock()
+		return nil
+	})
+}
+
+// Drain a particular worker and remove it. The policy replaces it if the pool drops below the
+// desired capacity
+func (m *Master) Drain(name string) error {
+	return m.control(func(loop loopChannels) error {
+		worker, err := m.namedWorker(name)
+		if err != nil {
+			return err
+		}
+
+		m.startRemoving(worker, loop.drained)
+		return nil
+	})
+}
+
+// Hand the current workers to the load balancer again, the same way worker changes are. Config
+// files are rewritten, and the load balancer picks them up through its runtime API or a reload
+func (m *Master) Reload() error {
+	return m.control(func(loop loopChannels) error {
+		return m.loadBalancer.SetServers(m.backendServers())
+	})
+}
+
+// A worker that isn't already being removed, by name
+func (m *Master) namedWorker(name string) (*Worker, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, worker := range m.workers {
+		if worker.instance.Name != name {
+			continue
+		}
+		if worker.draining {
+			return nil, conflict("%s is already being removed", name)
+		}
+		return worker, nil
+	}
+	return nil, &NotFoundError{fmt.Sprintf("no worker named %s in pool %s", name, m.name)}
+}
@@ -0,0 +1,95 @@
+package master
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronMatches(t *testing.T) {
+	// 4 March 2024 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.March, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr string
+		time time.Time
+		want bool
+	}{
+		{"* * * * *", at(4, 10, 31), true},
+		{"*/15 * * * *", at(4, 10, 30), true},
+		{"*/15 * * * *", at(4, 10, 31), false},
+		{"5/20 * * * *", at(4, 10, 25), true},
+		{"5/20 * * * *", at(4, 10, 20), false},
+		{"0,30 * * * *", at(4, 10, 30), true},
+		{"0 9-17 * * 1-5", at(4, 9, 0), true},
+		{"0 9-17 * * 1-5", at(4, 18, 0), false},
+		{"0 9-17 * * 1-5", at(9, 9, 0), false},
+		{"30 8 1 * *", at(1, 8, 30), true},
+		{"30 8 1 * *", at(4, 8, 30), false},
+		{"0 0 * 3 *", at(4, 0, 0), true},
+		{"0 0 * 4 *", at(4, 0, 0), false},
+		// With both day fields restricted, either one matching is enough
+		{"0 0 1 * 1", at(4, 0, 0), true},
+		{"0 0 1 * 1", at(1, 0, 0), true},
+		{"0 0 1 * 1", at(5, 0, 0), false},
+		{"0 0 * * 7", at(3, 0, 0), true},
+		{"0 0 * * 0", at(3, 0, 0), true},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("'%s': %s", test.expr, err)
+			continue
+		}
+		if got := schedule.matches(test.time); got != test.want {
+			t.Errorf("'%s' matches %s: %t, want %t", test.expr, test.time.Format("Mon 2 Jan 15:04"), got, test.want)
+		}
+	}
+}
+
+func TestCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("no error for '%s'", expr)
+		}
+	}
+}
+
+func TestCronLastFired(t *testing.T) {
+	schedule, err := parseCron("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		now       time.Time
+		wantFired bool
+	}{
+		{time.Date(2024, time.March, 4, 8, 59, 0, 0, time.UTC), false},
+		{time.Date(2024, time.March, 4, 9, 0, 30, 0, time.UTC), true},
+		{time.Date(2024, time.March, 4, 9, 59, 0, 0, time.UTC), true},
+		{time.Date(2024, time.March, 4, 10, 1, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		fired, ok := schedule.lastFired(test.now, time.Hour)
+		if ok != test.wantFired {
+			t.Errorf("at %s fired %t, want %t", test.now.Format("15:04:05"), ok, test.wantFired)
+		} else if ok && (fired.Hour() != 9 || fired.Minute() != 0) {
+			t.Errorf("at %s last fired %s, want 09:00", test.now.Format("15:04:05"), fired.Format("15:04"))
+		}
+	}
+}
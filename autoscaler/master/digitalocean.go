@@ -0,0 +1,215 @@
+package master
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"golang.org/x/oauth2"
+)
+
+// TokenSource type for Digital Ocean client
+type TokenSource struct {
+	AccessToken string
+}
+
+func (t *TokenSource) Token() (*oauth2.Token, error) {
+	token := &oauth2.Token{
+		AccessToken: t.AccessToken,
+	}
+	return token, nil
+}
+
+// Provider backed by the Digital Ocean droplets API
+type DigitalOceanProvider struct {
+	client *godo.Client
+}
+
+func NewDigitalOceanProvider(token string) *DigitalOceanProvider {
+	tokenSource := &TokenSource{
+		AccessToken: token,
+	}
+	oauthClient := oauth2.NewClient(context.Background(), tokenSource)
+
+	return &DigitalOceanProvider{
+		client: godo.NewClient(oauthClient),
+	}
+}
+
+// Point the provider at a different API endpoint, such as a local fake API server
+func (p *DigitalOceanProvider) SetBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+
+	// godo resolves request paths relative to the base URL, so it needs a trailing slash
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	p.client.BaseURL = u
+	return nil
+}
+
+func (p *DigitalOceanProvider) ListInstances() ([]Instance, error) {
+	return p.listAll(func(opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+		return p.client.Droplets.List(context.Background(), opt)
+	})
+}
+
+func (p *DigitalOceanProvider) ListInstancesByTag(tag string) ([]Instance, error) {
+	return p.listAll(func(opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+		return p.client.Droplets.ListByTag(context.Background(), tag, opt)
+	})
+}
+
+// Walk through every page of a droplet listing
+func (p *DigitalOceanProvider) listAll(list func(*godo.ListOptions) ([]godo.Droplet, *godo.Response, error)) ([]Instance, error) {
+	var instances []Instance
+	opt := &godo.ListOptions{
+		PerPage: 200,
+	}
+
+	for {
+		droplets, resp, err := list(opt)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+
+		for _, droplet := range droplets {
+			instances = append(instances, newInstanceFromDroplet(&droplet))
+		}
+
+		if resp == nil || resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		opt.Page = page + 1
+	}
+
+	return instances, nil
+}
+
+func (p *DigitalOceanProvider) CreateInstance(request *InstanceRequest) (*Instance, error) {
+	createRequest := &godo.DropletCreateRequest{
+		Name:              request.Name,
+		Region:            request.Region,
+		Size:              request.Size,
+		IPv6:              request.IPv6,
+		PrivateNetworking: request.PrivateNetworking,
+		VPCUUID:           request.VPCUUID,
+		Monitoring:        request.Monitoring,
+		UserData:          request.UserData,
+		Tags:              request.Tags,
+		Image: godo.DropletCreateImage{
+			ID:   request.ImageID,
+			Slug: request.ImageSlug,
+		},
+	}
+	for _, fingerprint := range request.SSHKeys {
+		createRequest.SSHKeys = append(createRequest.SSHKeys, godo.DropletCreateSSHKey{Fingerprint: fingerprint})
+	}
+
+	droplet, _, err := p.client.Droplets.Create(context.Background(), createRequest)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	instance := newInstanceFromDroplet(droplet)
+	return &instance, nil
+}
+
+func (p *DigitalOceanProvider) GetInstance(id int) (*Instance, error) {
+	droplet, _, err := p.client.Droplets.Get(context.Background(), id)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	instance := newInstanceFromDroplet(droplet)
+	return &instance, nil
+}
+
+func (p *DigitalOceanProvider) DeleteInstance(id int) error {
+	_, err := p.client.Droplets.Delete(context.Background(), id)
+	return wrapError(err)
+}
+
+func (p *DigitalOceanProvider) Addresses(instance *Instance) (privateAddr, publicAddr string) {
+	for _, addr := range instance.Networks {
+		if addr.Version != 4 {
+			continue
+		}
+		if addr.Type == "private" {
+			privateAddr = addr.Address
+		} else if addr.Type == "public" {
+			publicAddr = addr.Address
+		}
+	}
+	return privateAddr, publicAddr
+}
+
+func newInstanceFromDroplet(droplet *godo.Droplet) Instance {
+	instance := Instance{
+		ID:     droplet.ID,
+		Name:   droplet.Name,
+		Status: droplet.Status,
+		Size:   droplet.SizeSlug,
+		Tags:   droplet.Tags,
+	}
+	if droplet.Region != nil {
+		instance.Region = droplet.Region.Slug
+	}
+	if created, err := time.Parse(time.RFC3339, droplet.Created); err == nil {
+		instance.Created = created
+	}
+
+	if droplet.Networks != nil {
+		for _, addr := range droplet.Networks.V4 {
+			instance.Networks = append(instance.Networks, NetworkAddress{addr.Type, addr.IPAddress, 4})
+		}
+		for _, addr := range droplet.Networks.V6 {
+			instance.Networks = append(instance.Networks, NetworkAddress{addr.Type, addr.IPAddress, 6})
+		}
+	}
+
+	return instance
+}
+
+func (p *DigitalOceanProvider) LoadBalancerInstances(id string) ([]int, error) {
+	loadBalancer, _, err := p.client.LoadBalancers.Get(context.Background(), id)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return loadBalancer.DropletIDs, nil
+}
+
+func (p *DigitalOceanProvider) AddToLoadBalancer(id string, instanceIDs ...int) error {
+	_, err := p.client.LoadBalancers.AddDroplets(context.Background(), id, instanceIDs...)
+	return wrapError(err)
+}
+
+func (p *DigitalOceanProvider) RemoveFromLoadBalancer(id string, instanceIDs ...int) error {
+	_, err := p.client.LoadBalancers.RemoveDroplets(context.Background(), id, instanceIDs...)
+	return wrapError(err)
+}
+
+// Mark client errors (other than rate limiting) as permanent so they aren't retried, and missing
+// resources as such
+func wrapError(err error) error {
+	if errorResponse, ok := err.(*godo.ErrorResponse); ok && errorResponse.Response != nil {
+		status := errorResponse.Response.StatusCode
+		if status == http.StatusNotFound {
+			return &PermanentError{&MissingError{err}}
+		}
+		if status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+			return &PermanentError{err}
+		}
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+package master
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jstol/digital-ocean-autoscaler/fakedo"
+)
+
+// A Digital Ocean provider talking to a fake API server
+func newFakeDigitalOcean(t *testing.T, bootTime time.Duration) (*fakedo.Server, *DigitalOceanProvider, func()) {
+	server := fakedo.NewServer(bootTime)
+	server.Token = "token"
+	ts := httptest.NewServer(server)
+
+	provider := NewDigitalOceanProvider("token")
+	if err := provider.SetBaseURL(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	return server, provider, ts.Close
+}
+
+func instanceNames(instances []Instance) []string {
+	var names []string
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func workerNames(workers []*Worker) []string {
+	var names []string
+	for _, worker := range workers {
+		names = append(names, worker.instance.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDigitalOceanListing(t *testing.T) {
+	server, provider, done := newFakeDigitalOcean(t, 0)
+	defer done()
+
+	// More droplets than fit on one page of 200
+	for i := 0; i < 250; i++ {
+		if i%50 == 0 {
+			server.AddDroplet(fmt.Sprintf("web-%d", i), "web")
+		} else {
+			server.AddDroplet(fmt.Sprintf("other-%d", i))
+		}
+	}
+
+	all, err := provider.ListInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 250 {
+		t.Errorf("listed %d droplets, want 250", len(all))
+	}
+	seen := make(map[int]bool)
+	for _, instance := range all {
+		if seen[instance.ID] {
+			t.Fatalf("droplet %d listed twice", instance.ID)
+		}
+		seen[instance.ID] = true
+	}
+
+	tagged, err := provider.ListInstancesByTag("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(instanceNames(tagged)); got != "[web-0 web-100 web-150 web-200 web-50]" {
+		t.Errorf("tagged droplets %s", got)
+	}
+	if privateAddr, publicAddr := provider.Addresses(&tagged[0]); privateAddr == "" || publicAddr == "" {
+		t.Errorf("addresses %q and %q, want both", privateAddr, publicAddr)
+	}
+}
+
+func TestDigitalOceanErrors(t *testing.T) {
+	_, provider, done := newFakeDigitalOcean(t, 0)
+	defer done()
+
+	if _, err := provider.GetInstance(1); !isMissing(err) {
+		t.Errorf("getting a missing droplet: %v, want a permanent missing error", err)
+	}
+
+	unauthorized := NewDigitalOceanProvider("wrong")
+	unauthorized.client.BaseURL = provider.client.BaseURL
+	if _, err := unauthorized.ListInstances(); !isPermanent(err) {
+		t.Errorf("listing with a bad token: %v, want a permanent error", err)
+	}
+}
+
+func TestNewMasterDiscovery(t *testing.T) {
+	server, provider, done := newFakeDigitalOcean(t, 0)
+	defer done()
+
+	server.AddDroplet("base-1")
+	server.AddDroplet("web-a", "web")
+	server.AddDroplet("web-b", "web")
+	server.AddDroplet("api-a", "api")
+	server.AddDroplet("stray")
+	lb := server.AddLoadBalancer("web")
+
+	m, err := NewMaster("localhost:5555", &WorkerConfig{
+		Name:                     "web",
+		NamePrefix:               "web",
+		Tag:                      "web",
+		DropletNames:             []string{"base-1"},
+		LoadBalancer:             "digitalocean",
+		DigitalOceanLoadBalancer: DigitalOceanLoadBalancerConfig{ID: lb.ID},
+	}, provider, "", "", "", "test-image", 0.65, 0.2, 1, 5, time.Millisecond, time.Minute, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprint(workerNames(m.workers)); got != "[base-1 web-a web-b]" {
+		t.Errorf("discovered %s", got)
+	}
+
+	// The discovered workers go behind the load balancer
+	m.updateLoadBalancer()
+	if current, _ := server.LoadBalancer(lb.ID); len(current.DropletIDs) != 3 {
+		t.Errorf("load balancer has droplets %v, want the 3 workers", current.DropletIDs)
+	}
+
+	// A pool whose tag finds nothing starts empty and launches its minimum, though no worker ever
+	// reports
+	m, err = NewMaster("localhost:5555", &WorkerConfig{
+		Name:                     "cache",
+		NamePrefix:               "cache",
+		Tag:                      "cache",
+		LoadBalancer:             "digitalocean",
+		DigitalOceanLoadBalancer: DigitalOceanLoadBalancerConfig{ID: lb.ID},
+		MaxSurge:                 2,
+	}, provider, "", "", "", "test-image", 0.65, 0.2, 2, 5, time.Millisecond, time.Minute, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.workers) != 0 {
+		t.Fatalf("discovered %s, want no workers", workerNames(m.workers))
+	}
+
+	m.capacityCheckInterval = 5 * time.Millisecond
+	go m.monitor()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.lock.RLock()
+		names := workerNames(m.workers)
+		m.lock.RUnlock()
+		if len(names) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has workers %v, want 2", names)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	tagged, _ := provider.ListInstancesByTag("cache")
+	if len(tagged) != 2 {
+		t.Errorf("%d droplets tagged cache, want 2", len(tagged))
+	}
+}
+
+func TestAddAndRemoveWorker(t *testing.T) {
+	server, provider, done := newFakeDigitalOcean(t, 30*time.Millisecond)
+	defer done()
+	lb := server.AddLoadBalancer("web")
+
+	m, err := NewMaster("localhost:5555", &WorkerConfig{
+		Name:                     "web",
+		NamePrefix:               "web",
+		Tag:                      "web",
+		LoadBalancer:             "digitalocean",
+		DigitalOceanLoadBalancer: DigitalOceanLoadBalancerConfig{ID: lb.ID},
+	}, provider, "", "", "", "test-image", 0.65, 0.2, 1, 5, 10*time.Millisecond, time.Minute, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The worker is only handed back once its droplet has booted
+	created := make(chan workerChange, 1)
+	name, err := m.newWorkerName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.addWorker(name, created)
+	var change workerChange
+	select {
+	case change = <-created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker never became active")
+	}
+	if change.err != nil {
+		t.Fatal(change.err)
+	}
+	if change.instance.Status != InstanceActive || !change.instance.HasTag("web") {
+		t.Errorf("created %+v, want an active droplet tagged web", change.instance)
+	}
+
+	droplets := server.Droplets()
+	if len(droplets) != 1 || droplets[0].Name != name {
+		t.Fatalf("droplets %+v, want just %s", droplets, name)
+	}
+
+	worker := newWorker(*change.instance, provider)
+	m.workers = append(m.workers, worker)
+	m.updateLoadBalancer()
+	if current, _ := server.LoadBalancer(lb.ID); fmt.Sprint(current.DropletIDs) != fmt.Sprint([]int{worker.instance.ID}) {
+		t.Errorf("load balancer has droplets %v, want %d", current.DropletIDs, worker.instance.ID)
+	}
+
+	deleted := make(chan workerChange, 1)
+	m.removeWorker(worker, deleted)
+	if change := <-deleted; change.err != nil {
+		t.Fatal(change.err)
+	}
+	if droplets := server.Droplets(); len(droplets) != 0 {
+		t.Errorf("droplets %+v left after removing the worker", droplets)
+	}
+	if current, _ := server.LoadBalancer(lb.ID); len(current.DropletIDs) != 0 {
+		t.Errorf("load balancer still has droplets %v", current.DropletIDs)
+	}
+}
@@ -0,0 +1,64 @@
+package master
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Find the instances making up the worker pool: the statically configured droplets plus every
+// droplet carrying the worker tag
+func discoverInstances(provider Provider, config *WorkerConfig) ([]Instance, error) {
+	var instances []Instance
+	seen := make(map[int]bool)
+
+	if len(config.DropletNames) > 0 {
+		// Create a set containing the configured worker nodes
+		workerSet := make(map[string]bool)
+		for _, name := range config.DropletNames {
+			workerSet[name] = true
+		}
+
+		allInstances, err := provider.ListInstances()
+		if err != nil {
+			return nil, fmt.Errorf("error getting the list of droplets: %s", err)
+		}
+		for _, instance := range allInstances {
+			if workerSet[instance.Name] {
+				instances = append(instances, instance)
+				seen[instance.ID] = true
+			}
+		}
+	}
+
+	if config.Tag != "" {
+		tagged, err := provider.ListInstancesByTag(config.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("error getting the droplets tagged '%s': %s", config.Tag, err)
+		}
+		for _, instance := range tagged {
+			if !seen[instance.ID] {
+				instances = append(instances, instance)
+				seen[instance.ID] = true
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+// Generate a worker name that doesn't collide with any of the given names
+func uniqueWorkerName(prefix string, taken map[string]bool) (string, error) {
+	prefix = strings.TrimSuffix(prefix, "-")
+	suffix := make([]byte, 3)
+
+	for {
+		if _, err := rand.Read(suffix); err != nil {
+			return "", fmt.Errorf("error generating a worker name: %s", err)
+		}
+		if name := fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(suffix)); !taken[name] {
+			return name, nil
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package master
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscoverySkipsInactiveDroplets(t *testing.T) {
+	provider := newFakeProvider()
+	provider.add("web-a", InstanceActive, time.Hour, "web")
+	provider.add("web-b", "new", time.Minute, "web")
+	provider.add("web-c", "off", time.Hour, "web")
+	provider.add("base-1", "archive", time.Hour)
+
+	m, _ := newTestMaster(t, provider, &WorkerConfig{NamePrefix: "web", Tag: "web", DropletNames: []string{"base-1"}})
+	if got := fmt.Sprint(workerNames(m.workers)); got != "[web-a]" {
+		t.Errorf("adopted %s, want only the active droplet", got)
+	}
+}
+
+func TestUniqueWorkerName(t *testing.T) {
+	taken := map[string]bool{"web-000000": true}
+	for i := 0; i < 100; i++ {
+		name, err := uniqueWorkerName("web-", taken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(name, "web-") || len(name) != len("web-000000") {
+			t.Fatalf("name %s, want web- and six hex digits", name)
+		}
+		if taken[name] {
+			t.Fatalf("%s was already taken", name)
+		}
+		taken[name] = true
+	}
+}
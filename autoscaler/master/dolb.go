@@ -0,0 +1,113 @@
+package master
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Which Digital Ocean Load Balancer the workers go behind
+type DigitalOceanLoadBalancerConfig struct {
+	ID string `json:"id"`
+}
+
+// Puts the workers behind a Digital Ocean Load Balancer by droplet ID. The load balancer has to
+// list droplets rather than target a tag, and is assumed to serve only this pool. It has no
+// weights or per-droplet stats, and removing a droplet is the only way to drain it
+type DigitalOceanLoadBalancer struct {
+	id       string
+	provider Provider
+
+	// Droplet ID of each worker, from the last SetServers
+	lock sync.Mutex
+	ids  map[string]int
+}
+
+func NewDigitalOceanLoadBalancer(config DigitalOceanLoadBalancerConfig, provider Provider) (*DigitalOceanLoadBalancer, error) {
+	if config.ID == "" {
+		return nil, fmt.Errorf("the digitalocean load balancer needs an id")
+	}
+	return &DigitalOceanLoadBalancer{id: config.ID, provider: provider, ids: make(map[string]int)}, nil
+}
+
+func (d *DigitalOceanLoadBalancer) SetServers(servers []BackendServer) error {
+	current, err := d.provider.LoadBalancerInstances(d.id)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	d.ids = make(map[string]int)
+	for _, server := range servers {
+		d.ids[server.Name] = server.ID
+	}
+	d.lock.Unlock()
+
+	registered := make(map[int]bool)
+	for _, id := range current {
+		registered[id] = true
+	}
+
+	// Drained droplets stay out of the load balancer
+	var add []int
+	wanted := make(map[int]bool)
+	for _, server := range servers {
+		if server.Draining {
+			continue
+		}
+		wanted[server.ID] = true
+		if !registered[server.ID] {
+			add = append(add, server.ID)
+		}
+	}
+	var remove []int
+	for _, id := range current {
+		if !wanted[id] {
+			remove = append(remove, id)
+		}
+	}
+
+	if len(add) > 0 {
+		fmt.Printf("Adding droplets %v to load balancer %s\n", add, d.id)
+		if err = d.provider.AddToLoadBalancer(d.id, add...); err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		fmt.Printf("Removing droplets %v from load balancer %s\n", remove, d.id)
+		if err = d.provider.RemoveFromLoadBalancer(d.id, remove...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Digital Ocean Load Balancers don't support weights
+func (d *DigitalOceanLoadBalancer) SetWeights(weights map[string]int64) []error {
+	return nil
+}
+
+// Take the droplet out of the load balancer. Without connection counts, the master waits out the
+// drain timeout before deleting it
+func (d *DigitalOceanLoadBalancer) Drain(name string) error {
+	d.lock.Lock()
+	id, ok := d.ids[name]
+	d.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown droplet %s", name)
+	}
+	return d.provider.RemoveFromLoadBalancer(d.id, id)
+}
+
+func (d *DigitalOceanLoadBalancer) Undrain(name string) error {
+	d.lock.Lock()
+	id, ok := d.ids[name]
+	d.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown droplet %s", name)
+	}
+	return d.provider.AddToLoadBalancer(d.id, id)
+}
+
+func (d *DigitalOceanLoadBalancer) Stats() (map[string]ServerStats, error) {
+	return nil, errStatsUnsupported
+}
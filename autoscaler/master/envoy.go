@@ -0,0 +1,253 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEnvoyCluster = "nodes"
+	defaultEnvoyPort    = 80
+
+	clusterLoadAssignmentType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+)
+
+// Where the workers go in Envoy
+type EnvoyConfig struct {
+	// Cluster the workers are endpoints of. Defaults to "nodes"
+	Cluster string `json:"cluster"`
+	// Port the workers serve on. Defaults to 80
+	Port int `json:"port"`
+	// File Envoy reads the cluster's endpoints from (its eds_config path)
+	EDSFile string `json:"edsFile"`
+	// Base URL of Envoy's admin interface, e.g. "http://127.0.0.1:9901", used for connection counts
+	Admin string `json:"admin"`
+}
+
+// Puts the workers in an Envoy cluster through file-based endpoint discovery (EDS). Envoy watches
+// the file, so changes apply without a restart
+type EnvoyLoadBalancer struct {
+	config EnvoyConfig
+	client *http.Client
+
+	lock    sync.Mutex
+	servers []BackendServer
+	drained map[string]bool
+	version int
+}
+
+// The EDS file format: a discovery response holding one ClusterLoadAssignment
+type envoyDiscoveryResponse struct {
+	VersionInfo string                       `json:"version_info"`
+	Resources   []envoyClusterLoadAssignment `json:"resources"`
+}
+
+type envoyClusterLoadAssignment struct {
+	Type        string                   `json:"@type"`
+	ClusterName string                   `json:"cluster_name"`
+	Endpoints   []envoyLocalityEndpoints `json:"endpoints"`
+}
+
+type envoyLocalityEndpoints struct {
+	LBEndpoints []envoyLBEndpoint `json:"lb_endpoints"`
+}
+
+type envoyLBEndpoint struct {
+	Endpoint            envoyEndpoint `json:"endpoint"`
+	HealthStatus        string        `json:"health_status,omitempty"`
+	LoadBalancingWeight int64         `json:"load_balancing_weight"`
+}
+
+type envoyEndpoint struct {
+	Address  envoyAddress `json:"address"`
+	Hostname string       `json:"hostname"`
+}
+
+type envoyAddress struct {
+	SocketAddress struct {
+		Address   string `json:"address"`
+		PortValue int    `json:"port_value"`
+	} `json:"socket_address"`
+}
+
+func NewEnvoyLoadBalancer(config EnvoyConfig) (*EnvoyLoadBalancer, error) {
+	if config.EDSFile == "" {
+		return nil, fmt.Errorf("the envoy load balancer needs an edsFile")
+	}
+	if config.Cluster == "" {
+		config.Cluster = defaultEnvoyCluster
+	}
+	if config.Port <= 0 {
+		config.Port = defaultEnvoyPort
+	}
+	config.Admin = strings.TrimSuffix(config.Admin, "/")
+
+	return &EnvoyLoadBalancer{
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		drained: make(map[string]bool),
+	}, nil
+}
+
+func (e *EnvoyLoadBalancer) SetServers(servers []BackendServer) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.servers = append([]BackendServer{}, servers...)
+	current := make(map[string]bool)
+	for _, server := range servers {
+		current[server.Name] = true
+	}
+	for name := range e.drained {
+		if !current[name] {
+			delete(e.drained, name)
+		}
+	}
+	return e.write()
+}
+
+func (e *EnvoyLoadBalancer) SetWeights(weights map[string]int64) []error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for i, server := range e.servers {
+		if weight, ok := weights[server.Name]; ok {
+			e.servers[i].Weight = weight
+		}
+	}
+	if err := e.write(); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// Mark the endpoint as draining, so Envoy stops sending it new requests
+func (e *EnvoyLoadBalancer) Drain(name string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.drained[name] = true
+	return e.write()
+}
+
+func (e *EnvoyLoadBalancer) Undrain(name string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	delete(e.drained, name)
+	return e.write()
+}
+
+// Write out the endpoints. Must be called with the lock held
+func (e *EnvoyLoadBalancer) write() error {
+	var endpoints []envoyLBEndpoint
+	for _, server := range e.servers {
+		endpoint := envoyLBEndpoint{LoadBalancingWeight: server.Weight}
+		endpoint.Endpoint.Hostname = server.Name
+		endpoint.Endpoint.Address.SocketAddress.Address = server.Addr
+		endpoint.Endpoint.Address.SocketAddress.PortValue = e.config.Port
+		// Envoy requires weights of at least 1
+		if endpoint.LoadBalancingWeight < 1 {
+			endpoint.LoadBalancingWeight = 1
+		}
+		if e.drained[server.Name] {
+			endpoint.HealthStatus = "DRAINING"
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	e.version++
+	data, err := json.MarshalIndent(envoyDiscoveryResponse{
+		VersionInfo: strconv.Itoa(e.version),
+		Resources: []envoyClusterLoadAssignment{{
+			Type:        clusterLoadAssignmentType,
+			ClusterName: e.config.Cluster,
+			Endpoints:   []envoyLocalityEndpoints{{endpoints}},
+		}},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Envoy only notices the file being moved into place, not written in place
+	tmp := e.config.EDSFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing endpoints file: %s", err)
+	}
+	if err = os.Rename(tmp, e.config.EDSFile); err != nil {
+		return fmt.Errorf("error moving endpoints file into place: %s", err)
+	}
+
+	fmt.Printf("Wrote %d endpoints for cluster %s (version %d)\n", len(endpoints), e.config.Cluster, e.version)
+	return nil
+}
+
+// Active connections to each endpoint, from the admin interface
+func (e *EnvoyLoadBalancer) Stats() (map[string]ServerStats, error) {
+	if e.config.Admin == "" {
+		return nil, errStatsUnsupported
+	}
+
+	resp, err := e.client.Get(e.config.Admin + "/clusters?format=json")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching cluster stats: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching cluster stats: %s", resp.Status)
+	}
+
+	var clusters struct {
+		ClusterStatuses []struct {
+			Name         string `json:"name"`
+			HostStatuses []struct {
+				Address envoyAddress `json:"address"`
+				Stats   []struct {
+					Name string `json:"name"`
+					// Counters and gauges are 64 bit, so they're encoded as strings
+					Value json.Number `json:"value"`
+				} `json:"stats"`
+			} `json:"host_statuses"`
+		} `json:"cluster_statuses"`
+	}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err = decoder.Decode(&clusters); err != nil {
+		return nil, fmt.Errorf("error parsing cluster stats: %s", err)
+	}
+
+	e.lock.Lock()
+	names := make(map[string]string)
+	for _, server := range e.servers {
+		names[server.Addr] = server.Name
+	}
+	e.lock.Unlock()
+
+	stats := make(map[string]ServerStats)
+	for _, cluster := range clusters.ClusterStatuses {
+		if cluster.Name != e.config.Cluster {
+			continue
+		}
+		for _, host := range cluster.HostStatuses {
+			name, ok := names[host.Address.SocketAddress.Address]
+			if !ok {
+				continue
+			}
+			var stat ServerStats
+			for _, s := range host.Stats {
+				if s.Name == "cx_active" {
+					stat.Sessions, _ = s.Value.Int64()
+				}
+			}
+			stats[name] = stat
+		}
+	}
+	return stats, nil
+}
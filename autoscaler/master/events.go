@@ -0,0 +1,68 @@
+package master
+
+import (
+	"fmt"
+	"time"
+)
+
+// Number of recent events kept in memory
+const maxEvents = 100
+
+type EventType string
+
+const (
+	// A worker's droplet no longer exists
+	EventWorkerMissing EventType = "worker-missing"
+	// An active droplet belonging to the pool was found that the master didn't know about
+	EventWorkerDiscovered EventType = "worker-discovered"
+	// A worker's droplet is no longer active
+	EventWorkerInactive EventType = "worker-inactive"
+	// A worker's private or public address changed
+	EventWorkerAddressChanged EventType = "worker-address-changed"
+	// A worker couldn't be taken out of rotation, so it was kept rather than removed
+	EventWorkerDrainFailed EventType = "worker-drain-failed"
+)
+
+// Event describing a change the master made to the worker set
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   EventType `json:"type"`
+	Worker string    `json:"worker"`
+	ID     int       `json:"id"`
+	Detail string    `json:"detail"`
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("[%s] %s %s (id=%d): %s", e.Time.Format(time.RFC3339), e.Type, e.Worker, e.ID, e.Detail)
+}
+
+// Record an event, print it and forward it to statsd
+func (m *Master) emit(eventType EventType, worker *Worker, detail string, v ...interface{}) {
+	event := Event{
+		Time:   time.Now(),
+		Type:   eventType,
+		Worker: worker.instance.Name,
+		ID:     worker.instance.ID,
+		Detail: fmt.Sprintf(detail, v...),
+	}
+	fmt.Printf("Event: %s\n", event)
+
+	m.eventsLock.Lock()
+	m.events = append(m.events, event)
+	if len(m.events) > maxEvents {
+		m.events = m.events[len(m.events)-maxEvents:]
+	}
+	m.eventsLock.Unlock()
+
+	if m.statsdClientBuffer != nil {
+		m.statsdClientBuffer.Incr(fmt.Sprintf("events.%s", eventType), 1)
+	}
+}
+
+// The most recent events, oldest first
+func (m *Master) Events() []Event {
+	m.eventsLock.Lock()
+	defer m.eventsLock.Unlock()
+
+	return append([]Event{}, m.events...)
+}
@@ -0,0 +1,224 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory Provider. Created instances are active straight away
+type fakeProvider struct {
+	lock      sync.Mutex
+	instances map[int]*Instance
+	nextID    int
+	created   []string
+	deleted   []int
+	// Instances behind each load balancer
+	loadBalancers map[string][]int
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{instances: make(map[int]*Instance), nextID: 100, loadBalancers: make(map[string][]int)}
+}
+
+// Add an existing instance, created the given time ago
+func (p *fakeProvider) add(name, status string, age time.Duration, tags ...string) Instance {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.nextID++
+	instance := &Instance{
+		ID:      p.nextID,
+		Name:    name,
+		Status:  status,
+		Tags:    tags,
+		Created: time.Now().Add(-age),
+		Networks: []NetworkAddress{
+			{"private", fmt.Sprintf("10.0.0.%d", p.nextID%254+1), 4},
+			{"public", fmt.Sprintf("192.0.2.%d", p.nextID%254+1), 4},
+		},
+	}
+	p.instances[instance.ID] = instance
+	return *instance
+}
+
+func (p *fakeProvider) list(keep func(*Instance) bool) []Instance {
+	var ids []int
+	for id := range p.instances {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var instances []Instance
+	for _, id := range ids {
+		if keep(p.instances[id]) {
+			instances = append(instances, *p.instances[id])
+		}
+	}
+	return instances
+}
+
+func (p *fakeProvider) ListInstances() ([]Instance, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.list(func(*Instance) bool { return true }), nil
+}
+
+func (p *fakeProvider) ListInstancesByTag(tag string) ([]Instance, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.list(func(i *Instance) bool { return i.HasTag(tag) }), nil
+}
+
+func (p *fakeProvider) CreateInstance(request *InstanceRequest) (*Instance, error) {
+	instance := p.add(request.Name, InstanceActive, 0, request.Tags...)
+
+	p.lock.Lock()
+	p.created = append(p.created, request.Name)
+	p.lock.Unlock()
+	return &instance, nil
+}
+
+func (p *fakeProvider) GetInstance(id int) (*Instance, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	instance, ok := p.instances[id]
+	if !ok {
+		return nil, &PermanentError{&MissingError{fmt.Errorf("no instance %d", id)}}
+	}
+	copied := *instance
+	return &copied, nil
+}
+
+func (p *fakeProvider) DeleteInstance(id int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.instances, id)
+	p.deleted = append(p.deleted, id)
+	return nil
+}
+
+func (p *fakeProvider) Addresses(instance *Instance) (privateAddr, publicAddr string) {
+	return (&DigitalOceanProvider{}).Addresses(instance)
+}
+
+func (p *fakeProvider) LoadBalancerInstances(id string) ([]int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]int{}, p.loadBalancers[id]...), nil
+}
+
+func (p *fakeProvider) AddToLoadBalancer(id string, instanceIDs ...int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.loadBalancers[id] = append(p.loadBalancers[id], instanceIDs...)
+	return nil
+}
+
+func (p *fakeProvider) RemoveFromLoadBalancer(id string, instanceIDs ...int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	remove := make(map[int]bool)
+	for _, instanceID := range instanceIDs {
+		remove[instanceID] = true
+	}
+	var kept []int
+	for _, instanceID := range p.loadBalancers[id] {
+		if !remove[instanceID] {
+			kept = append(kept, instanceID)
+		}
+	}
+	p.loadBalancers[id] = kept
+	return nil
+}
+
+func (p *fakeProvider) createdCount() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.created)
+}
+
+// LoadBalancer that records what it's asked to do. Every server reports the same session count
+type fakeLoadBalancer struct {
+	lock     sync.Mutex
+	servers  []BackendServer
+	drained  []string
+	sessions int64
+	// Number of times Drain and Undrain fail before they work
+	drainFailures, undrainFailures int
+}
+
+func (f *fakeLoadBalancer) SetServers(servers []BackendServer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.servers = servers
+	return nil
+}
+
+func (f *fakeLoadBalancer) SetWeights(weights map[string]int64) []error {
+	return nil
+}
+
+func (f *fakeLoadBalancer) Drain(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.drainFailures > 0 {
+		f.drainFailures--
+		return fmt.Errorf("runtime API unavailable")
+	}
+	f.drained = append(f.drained, name)
+	return nil
+}
+
+func (f *fakeLoadBalancer) Undrain(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.undrainFailures > 0 {
+		f.undrainFailures--
+		return fmt.Errorf("runtime API unavailable")
+	}
+	for i, drained := range f.drained {
+		if drained == name {
+			f.drained = append(f.drained[:i], f.drained[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeLoadBalancer) Stats() (map[string]ServerStats, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	stats := make(map[string]ServerStats)
+	for _, server := range f.servers {
+		stats[server.Name] = ServerStats{Sessions: f.sessions}
+	}
+	for _, name := range f.drained {
+		stats[name] = ServerStats{Sessions: f.sessions}
+	}
+	return stats, nil
+}
+
+// A master for the pool described by config, managing its workers through provider and putting
+// them behind a fake load balancer. Bounds are 1 to 5 workers, thresholds 0.65 and 0.2
+func newTestMaster(t *testing.T, provider Provider, config *WorkerConfig) (*Master, *fakeLoadBalancer) {
+	if config.LoadBalancer == "" {
+		config.LoadBalancer = "digitalocean"
+		config.DigitalOceanLoadBalancer.ID = "lb"
+	}
+	m, err := NewMaster("localhost:5555", config, provider, "", "", "", "test-image",
+		0.65, 0.2, 1, 5, time.Millisecond, time.Minute, true, false)
+	if err != nil {
+		t.Fatalf("NewMaster: %s", err)
+	}
+
+	loadBalancer := &fakeLoadBalancer{}
+	m.loadBalancer = loadBalancer
+	return m, loadBalancer
+}
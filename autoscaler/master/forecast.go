@@ -0,0 +1,190 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultForecastSlotSize  = 900
+	defaultForecastLookahead = 600
+	defaultForecastSmoothing = 0.3
+)
+
+// Forecasting section of the worker config
+type ForecastConfig struct {
+	// "daily" or "weekly" pattern to learn. Forecasting is off when empty
+	Season string `json:"season"`
+	// Size (in seconds) of the slots the season is divided into. Defaults to 900
+	SlotSize int64 `json:"slotSize"`
+	// How far ahead (in seconds) to provision for. Should cover droplet boot time. Defaults to 600
+	Lookahead int64 `json:"lookahead"`
+	// Load average per worker to size the forecast for. Defaults to halfway between the thresholds
+	Target float64 `json:"target"`
+	// Weight given to the latest season when updating a slot, between 0 and 1. Defaults to 0.3
+	Smoothing float64 `json:"smoothing"`
+	// IANA time zone the season's days start in. Defaults to UTC
+	Timezone string `json:"timezone"`
+	// File the learned pattern is kept in across restarts
+	HistoryFile string `json:"historyFile"`
+}
+
+// Learned capacity for one slot of the season
+type forecastSlot struct {
+	Capacity float64 `json:"capacity"`
+	Seasons  int     `json:"seasons"`
+}
+
+// Contents of the forecast history file
+type forecastHistory struct {
+	Season   string                `json:"season"`
+	SlotSize int64                 `json:"slotSize"`
+	Slots    map[int]*forecastSlot `json:"slots"`
+}
+
+// Learns how many workers the pool needs through the day or week, and predicts the need ahead of time
+type Forecaster struct {
+	lock     sync.Mutex
+	config   ForecastConfig
+	season   time.Duration
+	location *time.Location
+	slots    map[int]*forecastSlot
+	// Peak capacity needed so far in the current slot, folded into slots when the slot ends
+	current     int
+	currentPeak float64
+}
+
+func NewForecaster(config ForecastConfig, overloaded, underused float64) (*Forecaster, error) {
+	f := &Forecaster{config: config, slots: map[int]*forecastSlot{}, current: -1}
+	switch config.Season {
+	case "daily":
+		f.season = 24 * time.Hour
+	case "weekly":
+		f.season = 7 * 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("unknown forecast season '%s'", config.Season)
+	}
+
+	if f.config.SlotSize <= 0 {
+		f.config.SlotSize = defaultForecastSlotSize
+	}
+	if f.config.Lookahead <= 0 {
+		f.config.Lookahead = defaultForecastLookahead
+	}
+	if f.config.Target <= 0 {
+		f.config.Target = (overloaded + underused) / 2
+	}
+	if f.config.Smoothing <= 0 || f.config.Smoothing > 1 {
+		f.config.Smoothing = defaultForecastSmoothing
+	}
+
+	var err error
+	if f.location, err = time.LoadLocation(config.Timezone); err != nil {
+		return nil, err
+	}
+
+	if config.HistoryFile != "" {
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Slot of the season a time falls in
+func (f *Forecaster) slot(t time.Time) int {
+	t = t.In(f.location)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if f.config.Season == "weekly" {
+		offset += time.Duration(t.Weekday()) * 24 * time.Hour
+	}
+	return int(offset / (time.Duration(f.config.SlotSize) * time.Second))
+}
+
+// Record the total load across the pool at a point in time
+func (f *Forecaster) Record(t time.Time, totalLoad float64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	slot := f.slot(t)
+	if slot != f.current {
+		f.fold()
+		f.current, f.currentPeak = slot, 0
+	}
+	f.currentPeak = math.Max(f.currentPeak, totalLoad/f.config.Target)
+}
+
+// Fold the finished slot's peak into what's been learned for it
+func (f *Forecaster) fold() {
+	if f.current < 0 {
+		return
+	}
+
+	learned, ok := f.slots[f.current]
+	if !ok {
+		f.slots[f.current] = &forecastSlot{f.currentPeak, 1}
+	} else {
+		learned.Capacity += f.config.Smoothing * (f.currentPeak - learned.Capacity)
+		learned.Seasons++
+	}
+
+	if f.config.HistoryFile != "" {
+		if err := f.save(); err != nil {
+			fmt.Printf("Couldn't save forecast history: %s\n", err)
+		}
+	}
+}
+
+// Predicted number of workers needed one lookahead from now. Returns false if nothing has been
+// learned for that time yet
+func (f *Forecaster) Forecast(now time.Time) (int64, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	learned, ok := f.slots[f.slot(now.Add(time.Duration(f.config.Lookahead)*time.Second))]
+	if !ok {
+		return 0, false
+	}
+	return int64(math.Ceil(learned.Capacity)), true
+}
+
+func (f *Forecaster) load() error {
+	data, err := ioutil.ReadFile(f.config.HistoryFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("couldn't read forecast history: %s", err)
+	}
+
+	var history forecastHistory
+	if err := json.Unmarshal(data, &history); err != nil {
+		return fmt.Errorf("couldn't parse forecast history: %s", err)
+	}
+	if history.Season != f.config.Season || history.SlotSize != f.config.SlotSize {
+		fmt.Printf("Forecast history in %s is for a different season or slot size, starting over\n", f.config.HistoryFile)
+		return nil
+	}
+	if history.Slots != nil {
+		f.slots = history.Slots
+	}
+	return nil
+}
+
+func (f *Forecaster) save() error {
+	data, err := json.Marshal(forecastHistory{f.config.Season, f.config.SlotSize, f.slots})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated history behind
+	tmp := f.config.HistoryFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.config.HistoryFile)
+}
@@ -0,0 +1,131 @@
+package master
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestForecast(t *testing.T) {
+	start := time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		smoothing float64
+		// Peak total load in the 10:00 slot, one per day
+		peaks  []float64
+		want   int64
+		wantOK bool
+	}{
+		{name: "nothing learned"},
+		{name: "first season is taken as is", peaks: []float64{2}, want: 4, wantOK: true},
+		{name: "later seasons are smoothed", smoothing: 0.5, peaks: []float64{2, 1}, want: 3, wantOK: true},
+		{name: "smoothing of 1 keeps only the latest", smoothing: 1, peaks: []float64{2, 1}, want: 2, wantOK: true},
+		{name: "default smoothing", peaks: []float64{2, 1}, want: 4, wantOK: true},
+		{name: "rounds up", smoothing: 0.5, peaks: []float64{2, 1.1, 1.1}, want: 3, wantOK: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewForecaster(ForecastConfig{
+				Season: "daily", SlotSize: 3600, Lookahead: 3600, Target: 0.5, Smoothing: test.smoothing,
+			}, 0.65, 0.2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for day, peak := range test.peaks {
+				slotStart := start.AddDate(0, 0, day)
+				f.Record(slotStart, peak/2)
+				f.Record(slotStart.Add(10*time.Minute), peak)
+				f.Record(slotStart.Add(20*time.Minute), peak/4)
+				// The slot is folded in once the next one starts
+				f.Record(slotStart.Add(time.Hour), 0)
+			}
+
+			forecast, ok := f.Forecast(start.Add(-time.Hour))
+			if ok != test.wantOK || forecast != test.want {
+				t.Errorf("forecast %d (%t), want %d (%t)", forecast, ok, test.want, test.wantOK)
+			}
+		})
+	}
+
+	if _, err := NewForecaster(ForecastConfig{Season: "monthly"}, 0.65, 0.2); err == nil {
+		t.Error("no error for an unknown season")
+	}
+}
+
+func TestForecastHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forecast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := ForecastConfig{Season: "weekly", SlotSize: 3600, Lookahead: 3600, Target: 0.5, HistoryFile: filepath.Join(dir, "history.json")}
+	start := time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+
+	f, err := NewForecaster(config, 0.65, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Record(start, 3)
+	f.Record(start.Add(time.Hour), 0)
+
+	// A new forecaster picks up what was learned, unless the slots are a different size
+	if f, err = NewForecaster(config, 0.65, 0.2); err != nil {
+		t.Fatal(err)
+	}
+	if forecast, ok := f.Forecast(start.Add(-time.Hour)); !ok || forecast != 6 {
+		t.Errorf("forecast %d (%t) after a restart, want 6", forecast, ok)
+	}
+	config.SlotSize = 900
+	if f, err = NewForecaster(config, 0.65, 0.2); err != nil {
+		t.Fatal(err)
+	}
+	if forecast, ok := f.Forecast(start.Add(-time.Hour)); ok {
+		t.Errorf("forecast %d from history with a different slot size", forecast)
+	}
+}
+
+func TestDesiredCapacityForecast(t *testing.T) {
+	tests := []struct {
+		name     string
+		forecast float64
+		override int64
+		want     int64
+	}{
+		{name: "forecast raises the policy's decision", forecast: 4, want: 4},
+		{name: "forecast below the policy's decision", forecast: 1, want: 2},
+		{name: "forecast kept within max", forecast: 9, want: 5},
+		{name: "override takes precedence", forecast: 4, override: 2, want: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider()
+			m, _ := newTestMaster(t, provider, &WorkerConfig{NamePrefix: "web"})
+			for i := 0; i < 2; i++ {
+				instance := provider.add(fmt.Sprintf("web-%d", i), InstanceActive, time.Hour)
+				m.workers = append(m.workers, newWorker(instance, provider))
+			}
+			if test.override > 0 {
+				m.desiredOverride = &test.override
+			}
+
+			now := time.Now()
+			var err error
+			if m.forecaster, err = NewForecaster(ForecastConfig{Season: "daily"}, 0.65, 0.2); err != nil {
+				t.Fatal(err)
+			}
+			m.forecaster.slots[m.forecaster.slot(now.Add(defaultForecastLookahead*time.Second))] = &forecastSlot{test.forecast, 1}
+
+			if desired := m.desiredCapacity(MetricsSnapshot{Time: now, LoadAvg: 0.4}); desired != test.want {
+				t.Errorf("desired %d, want %d", desired, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jstol/digital-ocean-autoscaler/haproxy"
+)
+
+const (
+	defaultHAProxySocket  = "/etc/haproxy/haproxy.sock"
+	defaultHAProxyBackend = "nodes"
+	defaultHAProxyPort    = 80
+	defaultSlotPrefix     = "slot"
+
+	// How worker changes reach HAProxy
+	haproxyModeReload  = "reload"
+	haproxyModeDynamic = "dynamic"
+	haproxyModeSlots   = "slots"
+)
+
+// Where to reach HAProxy's runtime API, and how to apply worker changes
+type HAProxyConfig struct {
+	// UNIX socket path or "tcp://host:port". Defaults to /etc/haproxy/haproxy.sock
+	Socket string `json:"socket"`
+	// Backend the workers are servers in. Defaults to "nodes"
+	Backend string `json:"backend"`
+	// "reload" (the default) rewrites the config and runs the reload command. "dynamic" adds and
+	// deletes servers through the runtime API, and "slots" fills the empty servers of a
+	// server-template. Either way the config is still written, for when HAProxy restarts
+	Mode string `json:"mode"`
+	// Port the workers serve on. Defaults to 80
+	Port int `json:"port"`
+	// Extra keywords for servers added in dynamic mode, e.g. ["check"]
+	ServerOptions []string `json:"serverOptions"`
+	// Prefix of the server-template's servers in slots mode. Defaults to "slot"
+	SlotPrefix string `json:"slotPrefix"`
+}
+
+// Puts the workers in an HAProxy backend, configured through a config file and the runtime API
+type HAProxyLoadBalancer struct {
+	client     *haproxy.Client
+	name       string
+	config     HAProxyConfig
+	drainState string
+	file       *configFile
+
+	// Slot each worker has been given, in slots mode
+	lock  sync.Mutex
+	slots map[string]string
+
+	// Each server's 5xx count at the last poll, for working out the rate
+	countersLock sync.Mutex
+	errorCounts  map[string]counterSample
+}
+
+type counterSample struct {
+	count int64
+	at    time.Time
+}
+
+func NewHAProxyLoadBalancer(config HAProxyConfig, drainState string, file *configFile) (*HAProxyLoadBalancer, error) {
+	if config.Socket == "" {
+		config.Socket = defaultHAProxySocket
+	}
+	if config.Backend == "" {
+		config.Backend = defaultHAProxyBackend
+	}
+	if config.Mode == "" {
+		config.Mode = haproxyModeReload
+	}
+	if config.Port <= 0 {
+		config.Port = defaultHAProxyPort
+	}
+	if config.SlotPrefix == "" {
+		config.SlotPrefix = defaultSlotPrefix
+	}
+	if drainState == "" {
+		drainState = defaultDrainState
+	}
+
+	switch config.Mode {
+	case haproxyModeReload, haproxyModeDynamic, haproxyModeSlots:
+	default:
+		return nil, fmt.Errorf("unknown haproxy mode '%s'", config.Mode)
+	}
+
+	return &HAProxyLoadBalancer{
+		client:      haproxy.NewClient(config.Socket),
+		name:        config.Backend,
+		config:      config,
+		drainState:  drainState,
+		file:        file,
+		slots:       make(map[string]string),
+		errorCounts: make(map[string]counterSample),
+	}, nil
+}
+
+// Write the config file, then apply it through the runtime API if it's enabled and by reloading
+// otherwise
+func (b *HAProxyLoadBalancer) SetServers(servers []BackendServer) error {
+	if err := b.file.write(servers); err != nil {
+		return err
+	}
+
+	if b.runtime() {
+		err := b.sync(servers)
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("Runtime update failed, reloading instead: %s\n", err.Error())
+	}
+	return b.file.reload()
+}
+
+// Whether worker changes are applied through the runtime API instead of a reload
+func (b *HAProxyLoadBalancer) runtime() bool {
+	return b.config.Mode != haproxyModeReload
+}
+
+// Name of a worker's server in the backend
+func (b *HAProxyLoadBalancer) serverName(worker string) string {
+	if b.config.Mode != haproxyModeSlots {
+		return worker
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if slot, ok := b.slots[worker]; ok {
+		return slot
+	}
+	return worker
+}
+
+// Name of the worker behind a server, or "" for an unused slot
+func (b *HAProxyLoadBalancer) workerName(server string) string {
+	if b.config.Mode != haproxyModeSlots {
+		return server
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for worker, slot := range b.slots {
+		if slot == server {
+			return worker
+		}
+	}
+	return ""
+}
+
+// Stats for each worker, from "show stat"
+func (b *HAProxyLoadBalancer) Stats() (map[string]ServerStats, error) {
+	stats, err := b.client.ServerStats(b.name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	servers := make(map[string]ServerStats)
+	for _, stat := range stats {
+		worker := b.workerName(stat.Server())
+		if worker == "" {
+			continue
+		}
+
+		server := ServerStats{Status: stat["status"], CheckStatus: stat["check_status"]}
+		var rate, rtime, errors int64
+		for column, value := range map[string]*int64{
+			"scur": &server.Sessions, "qcur": &server.Queue, "rate": &rate, "rtime": &rtime, "hrsp_5xx": &errors,
+		} {
+			if *value, err = stat.Int(column); err != nil {
+				return nil, fmt.Errorf("invalid %s for %s: %s", column, stat.Server(), err)
+			}
+		}
+		server.SessionRate = float64(rate)
+		server.ResponseTime = float64(rtime)
+		server.ErrorRate = b.errorRate(stat.Server(), errors, now)
+		servers[worker] = server
+	}
+	return servers, nil
+}
+
+// 5xx responses per second since the server was last polled
+func (b *HAProxyLoadBalancer) errorRate(server string, count int64, now time.Time) float64 {
+	b.countersLock.Lock()
+	defer b.countersLock.Unlock()
+
+	previous, ok := b.errorCounts[server]
+	b.errorCounts[server] = counterSample{count, now}
+
+	// Counters reset when HAProxy reloads or the server is re-added
+	elapsed := now.Sub(previous.at).Seconds()
+	if !ok || count < previous.count || elapsed <= 0 {
+		return 0
+	}
+	return float64(count-previous.count) / elapsed
+}
+
+func (b *HAProxyLoadBalancer) Drain(worker string) error {
+	return b.client.SetServerState(b.name, b.serverName(worker), b.drainState)
+}
+
+func (b *HAProxyLoadBalancer) Undrain(worker string) error {
+	return b.client.SetServerState(b.name, b.serverName(worker), "ready")
+}
+
+// Send every weight over one connection
+func (b *HAProxyLoadBalancer) SetWeights(weights map[string]int64) []error {
+	var commands []string
+	for worker, weight := range weights {
+		commands = append(commands, haproxy.SetWeightCommand(b.name, b.serverName(worker), weight))
+	}
+	return b.batch(commands)
+}
+
+func (b *HAProxyLoadBalancer) batch(commands []string) []error {
+	responses, err := b.client.Batch(commands...)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, response := range responses {
+		if response.Err != nil {
+			errs = append(errs, response.Err)
+		}
+	}
+	return errs
+}
+
+// Bring the backend's servers in line with the workers through the runtime API
+func (b *HAProxyLoadBalancer) sync(servers []BackendServer) error {
+	states, err := b.client.ShowServersState(b.name)
+	if err != nil {
+		return err
+	}
+
+	var (
+		commands []string
+		assigned map[string]string
+	)
+	if b.config.Mode == haproxyModeSlots {
+		commands, assigned, err = b.syncSlots(servers, states)
+		if err != nil {
+			return err
+		}
+	} else {
+		commands = b.syncDynamic(servers, states)
+	}
+
+	if len(commands) > 0 {
+		fmt.Printf("Updating %d servers in %s through the runtime API\n", len(servers), b.name)
+		if errs := b.batch(commands); len(errs) > 0 {
+			messages := make([]string, len(errs))
+			for i, err := range errs {
+				messages[i] = err.Error()
+			}
+			return fmt.Errorf("%s", strings.Join(messages, "; "))
+		}
+	}
+
+	// Slots are only given out once HAProxy has taken the changes, so a failed update is
+	// retried in full
+	if assigned != nil {
+		b.lock.Lock()
+		b.slots = assigned
+		b.lock.Unlock()
+	}
+	return nil
+}
+
+// Add servers for new workers and delete the servers of workers that are gone
+func (b *HAProxyLoadBalancer) syncDynamic(servers []BackendServer, states []haproxy.ServerState) []string {
+	existing := make(map[string]string)
+	for _, state := range states {
+		existing[state.Name()] = state.Addr()
+	}
+
+	var commands []string
+	wanted := make(map[string]bool)
+	for _, server := range servers {
+		wanted[server.Name] = true
+
+		addr, ok := existing[server.Name]
+		if !ok {
+			options := append([]string{"weight", strconv.FormatInt(server.Weight, 10)}, b.config.ServerOptions...)
+			commands = append(commands,
+				haproxy.AddServerCommand(b.name, server.Name, fmt.Sprintf("%s:%d", server.Addr, b.config.Port), options...),
+				haproxy.SetServerStateCommand(b.name, server.Name, "ready"))
+		} else if addr != server.Addr {
+			commands = append(commands, haproxy.SetServerAddrCommand(b.name, server.Name, server.Addr, b.config.Port))
+		}
+	}
+
+	// Servers have to be in maintenance before they can be deleted
+	for name := range existing {
+		if !wanted[name] {
+			commands = append(commands,
+				haproxy.SetServerStateCommand(b.name, name, "maint"),
+				haproxy.DelServerCommand(b.name, name))
+		}
+	}
+	return commands
+}
+
+// Point free server-template slots at new workers and put the slots of workers that are gone
+// into maintenance. Returns the commands and the slot each worker has once they've been applied
+func (b *HAProxyLoadBalancer) syncSlots(servers []BackendServer, states []haproxy.ServerState) ([]string, map[string]string, error) {
+	b.lock.Lock()
+	assigned := make(map[string]string, len(b.slots))
+	for worker, slot := range b.slots {
+		assigned[worker] = slot
+	}
+	b.lock.Unlock()
+
+	addrs := make(map[string]string)
+	maintenance := make(map[string]bool)
+	var slots []string
+	for _, state := range states {
+		if strings.HasPrefix(state.Name(), b.config.SlotPrefix) {
+			addrs[state.Name()] = state.Addr()
+			maintenance[state.Name()] = state.InMaintenance()
+			slots = append(slots, state.Name())
+		}
+	}
+	sort.Strings(slots)
+
+	wanted := make(map[string]BackendServer)
+	for _, server := range servers {
+		wanted[server.Name] = server
+	}
+
+	// Forget slots that are gone (e.g. after a restart) or whose worker has been removed
+	var commands []string
+	taken := make(map[string]bool)
+	for worker, slot := range assigned {
+		if _, ok := addrs[slot]; !ok {
+			delete(assigned, worker)
+		} else if _, ok := wanted[worker]; !ok {
+			commands = append(commands, haproxy.SetServerStateCommand(b.name, slot, "maint"))
+			delete(assigned, worker)
+		} else {
+			taken[slot] = true
+		}
+	}
+
+	// After a restart of the master, pick up slots already pointing at workers
+	for _, slot := range slots {
+		if taken[slot] {
+			continue
+		}
+		for _, server := range servers {
+			if _, ok := assigned[server.Name]; !ok && addrs[slot] == server.Addr {
+				assigned[server.Name] = slot
+				taken[slot] = true
+				break
+			}
+		}
+	}
+
+	for _, server := range servers {
+		slot, ok := assigned[server.Name]
+		if ok {
+			if addrs[slot] != server.Addr {
+				commands = append(commands, haproxy.SetServerAddrCommand(b.name, slot, server.Addr, b.config.Port))
+			}
+			// A slot whose enabling never went through is still in maintenance
+			if maintenance[slot] && !server.Draining {
+				commands = append(commands,
+					haproxy.SetWeightCommand(b.name, slot, server.Weight),
+					haproxy.SetServerStateCommand(b.name, slot, "ready"))
+			}
+			continue
+		}
+
+		for _, free := range slots {
+			if !taken[free] {
+				slot = free
+				break
+			}
+		}
+		if slot == "" {
+			return nil, nil, fmt.Errorf("no free %s slots in %s for %s", b.config.SlotPrefix, b.name, server.Name)
+		}
+
+		assigned[server.Name] = slot
+		taken[slot] = true
+		commands = append(commands,
+			haproxy.SetServerAddrCommand(b.name, slot, server.Addr, b.config.Port),
+			haproxy.SetWeightCommand(b.name, slot, server.Weight),
+			haproxy.SetServerStateCommand(b.name, slot, "ready"))
+	}
+	return commands, assigned, nil
+}
@@ -0,0 +1,264 @@
+package master
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jstol/digital-ocean-autoscaler/haproxy"
+)
+
+// HAProxy runtime API on a UNIX socket. Commands without a response are answered with an error
+type fakeRuntimeAPI struct {
+	lock      sync.Mutex
+	responses map[string]string
+	received  []string
+}
+
+func startFakeRuntimeAPI(t *testing.T, responses map[string]string) (*fakeRuntimeAPI, string, func()) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "haproxy.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	api := &fakeRuntimeAPI{responses: responses}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go api.serve(conn)
+		}
+	}()
+	return api, socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (a *fakeRuntimeAPI) serve(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	for _, command := range strings.Split(strings.TrimSpace(line), ";") {
+		a.lock.Lock()
+		a.received = append(a.received, command)
+		output, ok := a.responses[command]
+		a.lock.Unlock()
+		if !ok {
+			output = "Unknown command."
+		}
+		if output != "" {
+			output += "\n"
+		}
+		conn.Write([]byte(output + "\n"))
+	}
+}
+
+func (a *fakeRuntimeAPI) respond(command, output string) {
+	a.lock.Lock()
+	a.responses[command] = output
+	a.lock.Unlock()
+}
+
+func serverState(name, addr, adminState string) haproxy.ServerState {
+	return haproxy.ServerState{"be_name": "nodes", "srv_name": name, "srv_addr": addr, "srv_admin_state": adminState}
+}
+
+func TestHAProxySyncDynamic(t *testing.T) {
+	b, err := NewHAProxyLoadBalancer(HAProxyConfig{Mode: "dynamic", ServerOptions: []string{"check"}}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		states  []haproxy.ServerState
+		servers []BackendServer
+		want    []string
+	}{
+		{
+			name:    "adds a new worker",
+			servers: []BackendServer{{Name: "web-1", Addr: "10.0.0.1", Weight: 100}},
+			want: []string{
+				"add server nodes/web-1 10.0.0.1:80 weight 100 check",
+				"set server nodes/web-1 state ready",
+			},
+		},
+		{
+			name:    "leaves an unchanged worker alone",
+			states:  []haproxy.ServerState{serverState("web-1", "10.0.0.1", "0")},
+			servers: []BackendServer{{Name: "web-1", Addr: "10.0.0.1", Weight: 100}},
+		},
+		{
+			name:    "moves a worker whose address changed",
+			states:  []haproxy.ServerState{serverState("web-1", "10.0.0.1", "0")},
+			servers: []BackendServer{{Name: "web-1", Addr: "10.0.0.9", Weight: 100}},
+			want:    []string{"set server nodes/web-1 addr 10.0.0.9 port 80"},
+		},
+		{
+			name:   "deletes a removed worker",
+			states: []haproxy.ServerState{serverState("web-1", "10.0.0.1", "0")},
+			want: []string{
+				"set server nodes/web-1 state maint",
+				"del server nodes/web-1",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if commands := b.syncDynamic(test.servers, test.states); !reflect.DeepEqual(commands, test.want) {
+			t.Errorf("%s: commands %q, want %q", test.name, commands, test.want)
+		}
+	}
+}
+
+func TestHAProxySyncSlots(t *testing.T) {
+	tests := []struct {
+		name    string
+		slots   map[string]string
+		states  []haproxy.ServerState
+		servers []BackendServer
+		want    []string
+		// Slots after the commands have gone through
+		wantSlots map[string]string
+		wantErr   bool
+	}{
+		{
+			name:    "gives a new worker the first free slot",
+			states:  []haproxy.ServerState{serverState("slot-2", "0.0.0.0", "5"), serverState("slot-1", "0.0.0.0", "5")},
+			servers: []BackendServer{{Name: "web-1", Addr: "10.0.0.1", Weight: 50}},
+			want: []string{
+				"set server nodes/slot-1 addr 10.0.0.1 port 80",
+				"set weight nodes/slot-1 50",
+				"set server nodes/slot-1 state ready",
+			},
+			wantSlots: map[string]string{"web-1": "slot-1"},
+		},
+		{
+			name:      "leaves an enabled slot alone",
+			slots:     map[string]string{"web-1": "slot-1"},
+			states:    []haproxy.ServerState{serverState("slot-1", "10.0.0.1", "0")},
+			servers:   []BackendServer{{Name: "web-1", Addr: "10.0.0.1", Weight: 50}},
+			wantSlots: map[string]string{"web-1": "slot-1"},
+		},
+		{
+			name:    "enables a slot left in maintenance",
+			slots:   map[string]string{"web-1": "slot-1"},
+			states:  []haproxy.ServerState{serverState("slot-1", "10.0.0.1", "1")},
+			servers: []BackendServer{{Name: "web-1", Addr: "10.0.0.1", Weight: 50}},
+			want: []string{
+				"set weight nodes/slot-1 50",
+				"set server nodes/slot-1 state ready",
+			},
+			wantSlots: map[string]string{"web-1": "slot-1"},
+		},
+		{
+			name:      "leaves a draining worker in maintenance",
+			slots:     map[string]string{"web-1": "slot-1"},
+			states:    []haproxy.ServerState{serverState("slot-1", "10.0.0.1", "1")},
+			servers:   []BackendServer{{Name: "web-1", Addr: "10.0.0.1", Weight: 50, Draining: true}},
+			wantSlots: map[string]string{"web-1": "slot-1"},
+		},
+		{
+			name:      "picks up a slot pointing at a worker after a restart",
+			states:    []haproxy.ServerState{serverState("slot-1", "0.0.0.0", "5"), serverState("slot-2", "10.0.0.2", "0")},
+			servers:   []BackendServer{{Name: "web-2", Addr: "10.0.0.2", Weight: 50}},
+			wantSlots: map[string]string{"web-2": "slot-2"},
+		},
+		{
+			name:      "puts a removed worker's slot into maintenance",
+			slots:     map[string]string{"web-1": "slot-1"},
+			states:    []haproxy.ServerState{serverState("slot-1", "10.0.0.1", "0")},
+			want:      []string{"set server nodes/slot-1 state maint"},
+			wantSlots: map[string]string{},
+		},
+		{
+			name:    "no free slots",
+			slots:   map[string]string{"web-1": "slot-1"},
+			states:  []haproxy.ServerState{serverState("slot-1", "10.0.0.1", "0")},
+			servers: []BackendServer{{Name: "web-1", Addr: "10.0.0.1"}, {Name: "web-2", Addr: "10.0.0.2"}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := NewHAProxyLoadBalancer(HAProxyConfig{Mode: "slots", SlotPrefix: "slot-"}, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for worker, slot := range test.slots {
+				b.slots[worker] = slot
+			}
+
+			commands, assigned, err := b.syncSlots(test.servers, test.states)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(commands, test.want) {
+				t.Errorf("commands %q, want %q", commands, test.want)
+			}
+			if err == nil && !reflect.DeepEqual(assigned, test.wantSlots) {
+				t.Errorf("slots %v, want %v", assigned, test.wantSlots)
+			}
+		})
+	}
+}
+
+func TestHAProxySyncSlotsRetriesFailedUpdate(t *testing.T) {
+	api, socket, done := startFakeRuntimeAPI(t, map[string]string{
+		"show servers state nodes": "1\n# be_name srv_name srv_addr srv_admin_state\nnodes slot-1 0.0.0.0 5",
+		"set server nodes/slot-1 addr 10.0.0.1 port 80": "",
+		"set weight nodes/slot-1 50":                    "",
+		"set server nodes/slot-1 state ready":           "No such server.",
+	})
+	defer done()
+
+	b, err := NewHAProxyLoadBalancer(HAProxyConfig{Socket: socket, Mode: "slots", SlotPrefix: "slot-"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []BackendServer{{Name: "web-1", Addr: "10.0.0.1", Weight: 50}}
+
+	if err := b.sync(servers); err == nil {
+		t.Fatal("no error when the slot couldn't be enabled")
+	}
+	if len(b.slots) != 0 {
+		t.Errorf("slots %v after a failed update, want none", b.slots)
+	}
+
+	// The address went through, so the slot is picked up again but still has to be enabled
+	api.respond("show servers state nodes", "1\n# be_name srv_name srv_addr srv_admin_state\nnodes slot-1 10.0.0.1 1")
+	api.respond("set server nodes/slot-1 state ready", "")
+	api.lock.Lock()
+	api.received = nil
+	api.lock.Unlock()
+	if err := b.sync(servers); err != nil {
+		t.Fatal(err)
+	}
+	api.lock.Lock()
+	if want := []string{"show servers state nodes", "set weight nodes/slot-1 50", "set server nodes/slot-1 state ready"}; !reflect.DeepEqual(api.received, want) {
+		t.Errorf("HAProxy received %q, want %q", api.received, want)
+	}
+	api.lock.Unlock()
+	if b.serverName("web-1") != "slot-1" {
+		t.Errorf("web-1 is in %s, want slot-1", b.serverName("web-1"))
+	}
+}
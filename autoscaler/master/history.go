@@ -0,0 +1,77 @@
+package master
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultHistorySize = 1000
+
+// A metric value at a point in time
+type Datapoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// Bounded history of survey snapshots, oldest first
+type MetricHistory struct {
+	lock      sync.RWMutex
+	size      int
+	snapshots []MetricsSnapshot
+}
+
+func NewMetricHistory(size int) *MetricHistory {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	return &MetricHistory{size: size}
+}
+
+func (h *MetricHistory) Record(snapshot MetricsSnapshot) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.snapshots = append(h.snapshots, snapshot)
+	if len(h.snapshots) > h.size {
+		h.snapshots = h.snapshots[len(h.snapshots)-h.size:]
+	}
+}
+
+// Up to n of the most recent snapshots, oldest first
+func (h *MetricHistory) Latest(n int) []MetricsSnapshot {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if n > len(h.snapshots) {
+		n = len(h.snapshots)
+	}
+	return append([]MetricsSnapshot{}, h.snapshots[len(h.snapshots)-n:]...)
+}
+
+// Values of a metric reported by one worker
+func (h *MetricHistory) Worker(name, metric string) []Datapoint {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	var datapoints []Datapoint
+	for _, snapshot := range h.snapshots {
+		if value, ok := snapshot.WorkerMetrics[name][metric]; ok {
+			datapoints = append(datapoints, Datapoint{snapshot.Time, value})
+		}
+	}
+	return datapoints
+}
+
+// Values of a metric aggregated across the fleet at each survey
+func (h *MetricHistory) Fleet(metric, aggregation string) []Datapoint {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	var datapoints []Datapoint
+	for _, snapshot := range h.snapshots {
+		if value, ok := snapshot.aggregate(metric, aggregation); ok {
+			datapoints = append(datapoints, Datapoint{snapshot.Time, value})
+		}
+	}
+	return datapoints
+}
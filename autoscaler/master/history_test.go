@@ -0,0 +1,89 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetricHistory(t *testing.T) {
+	history := NewMetricHistory(3)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		history.Record(MetricsSnapshot{
+			Time: start.Add(time.Duration(i) * time.Minute),
+			WorkerMetrics: map[string]map[string]float64{
+				"web-a": {"requests": float64(i)},
+				"web-b": {"requests": float64(10 * i)},
+			},
+		})
+	}
+
+	values := func(datapoints []Datapoint) string {
+		var v []float64
+		for _, datapoint := range datapoints {
+			v = append(v, datapoint.Value)
+		}
+		return fmt.Sprint(v)
+	}
+
+	// Only the last 3 surveys are kept
+	if got := values(history.Worker("web-a", "requests")); got != "[1 2 3]" {
+		t.Errorf("web-a requests %s", got)
+	}
+	if got := values(history.Fleet("requests", "sum")); got != "[11 22 33]" {
+		t.Errorf("summed requests %s", got)
+	}
+	if got := values(history.Fleet("requests", "max")); got != "[10 20 30]" {
+		t.Errorf("max requests %s", got)
+	}
+	if got := history.Fleet("latency", ""); len(got) != 0 {
+		t.Errorf("unreported metric has history %v", got)
+	}
+}
+
+func TestHistoryAPI(t *testing.T) {
+	m, _ := newTestMaster(t, newFakeProvider(), &WorkerConfig{Name: "web", NamePrefix: "web"})
+	m.history.Record(MetricsSnapshot{
+		Time: time.Now(),
+		WorkerMetrics: map[string]map[string]float64{
+			"web-a": {"requests": 4},
+			"web-b": {"requests": 8},
+		},
+	})
+	api := NewAPIServer("", m)
+
+	tests := []struct {
+		query     string
+		wantCode  int
+		wantValue float64
+	}{
+		{"metric=requests", http.StatusOK, 6},
+		{"metric=requests&aggregation=sum", http.StatusOK, 12},
+		{"metric=requests&worker=web-b", http.StatusOK, 8},
+		{"metric=requests&aggregation=median", http.StatusBadRequest, 0},
+		{"", http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest("GET", "/pools/web/history?"+test.query, nil))
+		if recorder.Code != test.wantCode {
+			t.Errorf("%s: status %d, want %d", test.query, recorder.Code, test.wantCode)
+			continue
+		}
+		if test.wantCode != http.StatusOK {
+			continue
+		}
+
+		var datapoints []Datapoint
+		if err := json.Unmarshal(recorder.Body.Bytes(), &datapoints); err != nil {
+			t.Fatal(err)
+		}
+		if len(datapoints) != 1 || datapoints[0].Value != test.wantValue {
+			t.Errorf("%s: %+v, want one datapoint of %g", test.query, datapoints, test.wantValue)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package master
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"text/template"
+)
+
+const (
+	defaultRegion = "tor1"
+	defaultSize   = "512mb"
+)
+
+// Settings used when creating new worker droplets
+type LaunchTemplate struct {
+	Region     string   `json:"region"`
+	Size       string   `json:"size"`
+	ImageSlug  string   `json:"imageSlug"`
+	ImageID    int      `json:"imageID"`
+	SSHKeys    []string `json:"sshKeys"`
+	Tags       []string `json:"tags"`
+	IPv6       bool     `json:"ipv6"`
+	VPCUUID    string   `json:"vpcUUID"`
+	Monitoring bool     `json:"monitoring"`
+	// Cloud-init user data, either inline or read from a file. Both are run through text/template
+	UserData     string `json:"userData"`
+	UserDataFile string `json:"userDataFile"`
+	// Address new workers should use to reach the master. Defaults to the address the master binds to
+	MasterAddr string `json:"masterAddr"`
+}
+
+// Values available to the user data template
+type userDataInfo struct {
+	Name       string
+	Pool       string
+	NamePrefix string
+	MasterAddr string
+	Region     string
+	Size       string
+}
+
+// Override the configured image with the one given on the command line. Numeric values are
+// treated as snapshot IDs, anything else as a slug
+func (l *LaunchTemplate) SetImage(image string) {
+	if id, err := strconv.Atoi(image); err == nil {
+		l.ImageID, l.ImageSlug = id, ""
+	} else {
+		l.ImageID, l.ImageSlug = 0, image
+	}
+}
+
+func (l *LaunchTemplate) HasImage() bool {
+	return l.ImageSlug != "" || l.ImageID != 0
+}
+
+// Parse the user data template, reading it in from disk if needed
+func (l *LaunchTemplate) userDataTemplate() (*template.Template, error) {
+	userData := l.UserData
+	if l.UserDataFile != "" {
+		contents, err := ioutil.ReadFile(l.UserDataFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading user data file: %s", err)
+		}
+		userData = string(contents)
+	}
+
+	return template.New("userData").Option("missingkey=error").Parse(userData)
+}
+
+// Build the request used to launch a worker with the given name
+func (l *LaunchTemplate) instanceRequest(name string, userData *template.Template, info userDataInfo) (*InstanceRequest, error) {
+	region, size := l.Region, l.Size
+	if region == "" {
+		region = defaultRegion
+	}
+	if size == "" {
+		size = defaultSize
+	}
+
+	info.Name, info.Region, info.Size = name, region, size
+
+	var rendered bytes.Buffer
+	if err := userData.Execute(&rendered, info); err != nil {
+		return nil, fmt.Errorf("error rendering user data: %s", err)
+	}
+
+	return &InstanceRequest{
+		Name:              name,
+		Region:            region,
+		Size:              size,
+		ImageSlug:         l.ImageSlug,
+		ImageID:           l.ImageID,
+		SSHKeys:           l.SSHKeys,
+		Tags:              append([]string{}, l.Tags...),
+		IPv6:              l.IPv6,
+		VPCUUID:           l.VPCUUID,
+		Monitoring:        l.Monitoring,
+		UserData:          rendered.String(),
+		PrivateNetworking: true,
+	}, nil
+}
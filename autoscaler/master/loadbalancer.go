@@ -0,0 +1,287 @@
+package master
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDrainState   = "drain"
+	defaultDrainTimeout = 60 * time.Second
+	drainPollInterval   = 2 * time.Second
+	// Attempts at taking a worker out of rotation before its removal is abandoned
+	drainAttempts = 3
+)
+
+// Addresses the load balancer can reach workers on
+const (
+	addressPublic  = "public"
+	addressPrivate = "private"
+)
+
+// A worker as seen by the load balancer
+type BackendServer struct {
+	Name string
+	ID   int
+	// Address the load balancer reaches the worker on, public or private depending on the worker
+	// config's address setting
+	Addr        string
+	PublicAddr  string
+	PrivateAddr string
+	Region      string
+	Size        string
+	Tags        []string
+	Weight      int64
+	// Whether the worker is being drained before it's removed
+	Draining bool
+}
+
+// Metrics taken from the load balancer's stats, added to the metrics each worker reports
+const (
+	MetricLBSessions     = "lb_sessions"
+	MetricLBSessionRate  = "lb_session_rate"
+	MetricLBQueue        = "lb_queue"
+	MetricLBResponseTime = "lb_response_time"
+	MetricLB5xxRate      = "lb_5xx_rate"
+	MetricLBUp           = "lb_up"
+	MetricLBCheckOK      = "lb_check_ok"
+)
+
+// Numbers reported by the load balancer for one worker. Load balancers fill in what they can
+type ServerStats struct {
+	// Sessions currently open to the worker
+	Sessions int64 `json:"sessions"`
+	// New sessions per second
+	SessionRate float64 `json:"sessionRate"`
+	// Requests queued waiting for a connection to the worker
+	Queue int64 `json:"queue"`
+	// Average response time (in milliseconds) over recent requests
+	ResponseTime float64 `json:"responseTime"`
+	// 5xx responses per second since the last poll
+	ErrorRate float64 `json:"errorRate"`
+	// Status as the load balancer reports it, e.g. "UP" or "DOWN". Empty if unknown
+	Status string `json:"status,omitempty"`
+	// Result of the last health check, e.g. "L7OK". Empty if the worker isn't checked
+	CheckStatus string `json:"checkStatus,omitempty"`
+}
+
+func (s *ServerStats) metrics() map[string]float64 {
+	metrics := map[string]float64{
+		MetricLBSessions:     float64(s.Sessions),
+		MetricLBSessionRate:  s.SessionRate,
+		MetricLBQueue:        float64(s.Queue),
+		MetricLBResponseTime: s.ResponseTime,
+		MetricLB5xxRate:      s.ErrorRate,
+	}
+	if s.Status != "" {
+		// Unchecked HAProxy servers are always in rotation
+		status := strings.ToUpper(s.Status)
+		metrics[MetricLBUp] = boolMetric(strings.HasPrefix(status, "UP") || status == "NO CHECK")
+	}
+	if s.CheckStatus != "" {
+		// HAProxy's passing checks are L4OK, L6OK, L7OK and L7OKC
+		metrics[MetricLBCheckOK] = boolMetric(strings.Contains(s.CheckStatus, "OK"))
+	}
+	return metrics
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Returned by load balancers that can't report per-worker stats
+var errStatsUnsupported = fmt.Errorf("load balancer doesn't report per-server stats")
+
+// LoadBalancer is implemented by each load balancer the master can put workers behind
+type LoadBalancer interface {
+	// Register the given workers and deregister any others
+	SetServers(servers []BackendServer) error
+	// Apply new weights, keyed by worker name. Returns the errors for individual workers
+	SetWeights(weights map[string]int64) []error
+	// Stop sending new requests to a worker, letting its open sessions finish
+	Drain(name string) error
+	// Put a drained worker back into rotation
+	Undrain(name string) error
+	// Fetch the current stats for each worker, keyed by name
+	Stats() (map[string]ServerStats, error)
+}
+
+// How workers are taken out of rotation before they're deleted
+type DrainConfig struct {
+	// HAProxy server state to put the worker in: "drain" (the default) or "maint"
+	State string `json:"state"`
+	// Maximum time (in seconds) to wait for in-flight sessions to finish. Defaults to 60
+	Timeout int64 `json:"timeout"`
+}
+
+// Build the load balancer named in the worker config. The config file is used by the load
+// balancers that are configured through one
+func newLoadBalancer(config *WorkerConfig, provider Provider, file *configFile) (LoadBalancer, error) {
+	needsFile := func(name string) error {
+		if file == nil {
+			return fmt.Errorf("the %s load balancer needs a config template, config file and reload command", name)
+		}
+		return nil
+	}
+
+	switch config.LoadBalancer {
+	case "", "haproxy":
+		if err := needsFile("haproxy"); err != nil {
+			return nil, err
+		}
+		return NewHAProxyLoadBalancer(config.HAProxy, config.Drain.State, file)
+	case "nginx":
+		if err := needsFile("nginx"); err != nil {
+			return nil, err
+		}
+		return NewNginxLoadBalancer(config.Nginx, file), nil
+	case "envoy":
+		return NewEnvoyLoadBalancer(config.Envoy)
+	case "digitalocean":
+		return NewDigitalOceanLoadBalancer(config.DigitalOceanLoadBalancer, provider)
+	default:
+		return nil, fmt.Errorf("unknown load balancer '%s'", config.LoadBalancer)
+	}
+}
+
+// The backend or upstream the workers go in and the port they serve on, for the load balancers
+// configured through templates
+func templateBackend(config *WorkerConfig) (string, int) {
+	switch config.LoadBalancer {
+	case "", "haproxy":
+		backend, port := config.HAProxy.Backend, config.HAProxy.Port
+		if backend == "" {
+			backend = defaultHAProxyBackend
+		}
+		if port <= 0 {
+			port = defaultHAProxyPort
+		}
+		return backend, port
+	case "nginx":
+		upstream, port := config.Nginx.Upstream, config.Nginx.Port
+		if upstream == "" {
+			upstream = defaultNginxUpstream
+		}
+		if port <= 0 {
+			port = defaultNginxPort
+		}
+		return upstream, port
+	}
+	return "", 0
+}
+
+// Session counts for each worker, for selecting victims by connection count
+func sessionCounts(loadBalancer LoadBalancer) func() (map[string]int64, error) {
+	return func() (map[string]int64, error) {
+		stats, err := loadBalancer.Stats()
+		if err != nil {
+			return nil, err
+		}
+
+		sessions := make(map[string]int64)
+		for name, stat := range stats {
+			sessions[name] = stat.Sessions
+		}
+		return sessions, nil
+	}
+}
+
+// Poll the load balancer's stats, keep them on each worker and add them to the worker's metrics
+func (m *Master) addLoadBalancerMetrics(workerMetrics map[string]map[string]float64) {
+	stats, err := m.loadBalancer.Stats()
+	if err == errStatsUnsupported {
+		return
+	} else if err != nil {
+		fmt.Printf("Error fetching load balancer stats: %s\n", err.Error())
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, worker := range m.workers {
+		name := worker.instance.Name
+		stat, ok := stats[name]
+		if !ok {
+			worker.lbStats = nil
+			continue
+		}
+		worker.lbStats = &stat
+
+		// Copy the reported metrics rather than adding to the map the worker holds
+		metrics := make(map[string]float64)
+		for metric, value := range workerMetrics[name] {
+			metrics[metric] = value
+		}
+		for metric, value := range stat.metrics() {
+			metrics[metric] = value
+		}
+		workerMetrics[name] = metrics
+	}
+}
+
+// Number of sessions currently open to a worker
+func (m *Master) serverSessions(name string) (int64, error) {
+	stats, err := m.loadBalancer.Stats()
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := stats[name]
+	if !ok {
+		return 0, fmt.Errorf("no stats for %s", name)
+	}
+	return stat.Sessions, nil
+}
+
+// Outcome of draining a worker. If the worker couldn't be taken out of rotation err is set, and
+// the worker should be kept
+type drainResult struct {
+	worker *Worker
+	err    error
+}
+
+// Stop sending new requests to a worker and wait for its in-flight sessions to finish. Load
+// balancers that can't report sessions (errStatsUnsupported) are always given the whole timeout
+func (m *Master) drainWorker(worker *Worker, c chan<- drainResult) {
+	timeout := time.Duration(m.workerConfig.Drain.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	name := worker.instance.Name
+	err := m.loadBalancer.Drain(name)
+	for attempt := 1; err != nil && attempt < drainAttempts; attempt++ {
+		fmt.Printf("Couldn't drain %s (attempt %d/%d): %s. Retrying...\n", name, attempt, drainAttempts, err.Error())
+		time.Sleep(drainPollInterval)
+		err = m.loadBalancer.Drain(name)
+	}
+	if err != nil {
+		// Deleting the worker now would cut off its open sessions
+		c <- drainResult{worker, fmt.Errorf("couldn't drain %s, keeping it: %s", name, err)}
+		return
+	}
+
+	fmt.Printf("Draining %s (up to %s)\n", name, timeout)
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(drainPollInterval) {
+		sessions, err := m.serverSessions(name)
+		if err == errStatsUnsupported {
+			continue
+		} else if err != nil {
+			fmt.Printf("Error checking sessions on %s: %s\n", name, err.Error())
+			continue
+		}
+		if sessions == 0 {
+			fmt.Printf("Finished draining %s\n", name)
+			c <- drainResult{worker: worker}
+			return
+		}
+		fmt.Printf("Waiting on %d sessions to %s\n", sessions, name)
+	}
+
+	fmt.Printf("Timed out draining %s\n", name)
+	c <- drainResult{worker: worker}
+}
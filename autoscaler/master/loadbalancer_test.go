@@ -0,0 +1,56 @@
+package master
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDrainRetries(t *testing.T) {
+	provider := newFakeProvider()
+	m, loadBalancer := newTestMaster(t, provider, &WorkerConfig{NamePrefix: "web"})
+	worker := newWorker(provider.add("web-1", InstanceActive, time.Hour), provider)
+	loadBalancer.drainFailures = 1
+
+	drained := make(chan drainResult, 1)
+	m.drainWorker(worker, drained)
+	if result := <-drained; result.err != nil {
+		t.Fatalf("drain failed after a retry: %s", result.err)
+	}
+	if fmt.Sprint(loadBalancer.drained) != "[web-1]" {
+		t.Errorf("drained %v", loadBalancer.drained)
+	}
+}
+
+func TestFinishDraining(t *testing.T) {
+	provider := newFakeProvider()
+	m, _ := newTestMaster(t, provider, &WorkerConfig{NamePrefix: "web"})
+	kept := newWorker(provider.add("web-kept", InstanceActive, time.Hour), provider)
+	removed := newWorker(provider.add("web-removed", InstanceActive, time.Hour), provider)
+	m.workers = []*Worker{kept, removed}
+	for _, worker := range m.workers {
+		m.removing[worker.instance.ID] = true
+		worker.draining = true
+	}
+	deleted := make(chan workerChange, 1)
+
+	// A worker that couldn't be drained stays in service
+	m.finishDraining(drainResult{kept, fmt.Errorf("couldn't drain web-kept")}, deleted)
+	if kept.draining || m.removing[kept.instance.ID] {
+		t.Error("worker is still being removed after its drain failed")
+	}
+	if !m.degraded {
+		t.Error("a failed drain didn't count as a failed scaling action")
+	}
+	if events := m.Events(); len(events) != 1 || events[0].Type != EventWorkerDrainFailed {
+		t.Errorf("events %v", events)
+	}
+
+	m.finishDraining(drainResult{worker: removed}, deleted)
+	if change := <-deleted; change.err != nil || change.instance.ID != removed.instance.ID {
+		t.Errorf("deleted %+v", change)
+	}
+	if got := fmt.Sprint(workerNames(m.workers)); got != "[web-kept]" {
+		t.Errorf("workers %s", got)
+	}
+}
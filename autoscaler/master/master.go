@@ -2,375 +2,612 @@ package master
 
 import (
 	"fmt"
-	"math"
-	"net/url"
-	"os"
-	"os/exec"
-	"strconv"
-	"strings"
+	"sync"
 	"text/template"
 	"time"
 
-	"github.com/jstol/digital-ocean-autoscaler/utils"
+	"github.com/jstol/digital-ocean-autoscaler/protocol"
 
-	"github.com/digitalocean/godo"
-	"github.com/gdamore/mangos"
-	"github.com/gdamore/mangos/protocol/surveyor"
-	"github.com/gdamore/mangos/transport/tcp"
 	"github.com/quipo/statsd"
-	"golang.org/x/oauth2"
 )
 
-// TokenSource type for Digital Ocean client
-type TokenSource struct {
-	AccessToken string
-}
+// How long the monitor waits for a survey with metrics before it enforces the pool's limits on its
+// own, e.g. for a pool with no workers
+const defaultCapacityCheckInterval = 30 * time.Second
 
-func (t *TokenSource) Token() (*oauth2.Token, error) {
-	token := &oauth2.Token{
-		AccessToken: t.AccessToken,
-	}
-	return token, nil
-}
-
-// Type to hold droplet and private IP
+// Type to hold an instance and its private IP
 type Worker struct {
-	droplet     godo.Droplet
+	instance    Instance
 	privateAddr string
 	publicAddr  string
 	loadAvg     float64
 	weight      int64
+	joined      time.Time
+	draining    bool
+	// Taken out of rotation by an operator, but kept running
+	cordoned        bool
+	metrics         map[string]float64
+	protocolVersion int
+	// Latest stats from the load balancer, if it reports any
+	lbStats *ServerStats
 }
 
-func newWorker(droplet godo.Droplet) *Worker {
-	var privateAddr, publicAddr string
-	for _, addr := range droplet.Networks.V4 {
-		if addr.Type == "private" {
-			privateAddr = addr.IPAddress
-		} else if addr.Type == "public" {
-			publicAddr = addr.IPAddress
-		}
-	}
+func newWorker(instance Instance, provider Provider) *Worker {
+	privateAddr, publicAddr := provider.Addresses(&instance)
 
 	return &Worker{
-		droplet,
+		instance,
 		privateAddr,
 		publicAddr,
 		0,
 		1,
+		time.Now(),
+		false,
+		false,
+		nil,
+		0,
+		nil,
 	}
 }
 
-// Master type
+// Master manages one pool of workers
 type Master struct {
-	url                                                           url.URL
+	name                                                          string
 	scaleNodes, changeWeights                                     bool
 	workerConfig                                                  *WorkerConfig
 	workers                                                       []*Worker
-	command, balanceConfigTemplate, balanceConfigFile, imageID    string
+	lock                                                          sync.RWMutex
+	pending                                                       map[string]time.Time
+	removing                                                      map[int]bool
+	deleted                                                       map[int]time.Time
+	events                                                        []Event
+	eventsLock                                                    sync.Mutex
+	masterAddr                                                    string
+	userDataTemplate                                              *template.Template
+	victimSelector                                                VictimSelector
+	weightStrategy                                                WeightStrategy
+	weightInterval                                                time.Duration
+	policy                                                        ScalingPolicy
+	history                                                       *MetricHistory
+	schedule                                                      *Schedule
+	forecaster                                                    *Forecaster
+	lastScaleOut, lastScaleIn                                     time.Time
+	scaleOutDelay, scaleInDelay                                   time.Duration
 	currentLoadAvg, overloadedCpuThreshold, underusedCpuThreshold float64
 	minWorkers, maxWorkers, workerCount                           int64
-	waitingOnWorkerChange, coolingDown                            bool
-	token                                                         *TokenSource
-	doClient                                                      *godo.Client
-	pollInterval, cooldownInterval, surveyDeadline, queryInterval time.Duration
+	coolingDown, degraded                                         bool
+	provider                                                      Provider
+	loadBalancer                                                  LoadBalancer
+	pollInterval, cooldownInterval                                time.Duration
+	reconcileInterval, capacityCheckInterval                      time.Duration
+	maxSurge                                                      int64
 	statsdClientBuffer                                            *statsd.StatsdBuffer
+	// Responses to each survey from the pool's workers, passed on by the surveyor
+	reports chan []*protocol.Report
+	// Requests from the control API, carried out by the monitor loop
+	commands chan controlRequest
+	// Desired capacity set through the control API, overriding the policy and schedule
+	desiredOverride *int64
+	// Desired capacity at the last scaling decision
+	lastDesired int64
 }
 
-func NewMaster(host string, workerConfig *WorkerConfig, command, balanceConfigTemplate, balanceConfigFile, digitalOceanToken, digitalOceanImageID string,
-	overloadedCpuThreshold, underusedCpuThreshold float64, minWorkers, maxWorkers int64, pollInterval, cooldownInterval, surveyDeadline, queryInterval time.Duration,
-	scaleNodes, changeWeights bool) *Master {
+func NewMaster(host string, workerConfig *WorkerConfig, provider Provider, command, balanceConfigTemplate, balanceConfigFile, imageID string,
+	overloadedCpuThreshold, underusedCpuThreshold float64, minWorkers, maxWorkers int64, pollInterval, cooldownInterval time.Duration,
+	scaleNodes, changeWeights bool) (*Master, error) {
 
 	var err error
-	bindUrl := url.URL{Scheme: "tcp", Host: host}
 
-	// Set up the Digital Ocean client
-	tokenSource := &TokenSource{
-		AccessToken: digitalOceanToken,
+	// Apply the image given on the command line and make sure new workers can be launched
+	if imageID != "" {
+		workerConfig.Launch.SetImage(imageID)
+	}
+	if !workerConfig.Launch.HasImage() {
+		return nil, fmt.Errorf("no image configured for new workers")
 	}
-	oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource)
-	client := godo.NewClient(oauthClient)
 
-	// Create a set containing the configured worker nodes
-	workerSet := make(map[string]interface{})
-	for _, name := range workerConfig.DropletNames {
-		workerSet[name] = nil
+	var userDataTemplate *template.Template
+	if userDataTemplate, err = workerConfig.Launch.userDataTemplate(); err != nil {
+		return nil, fmt.Errorf("error parsing user data template: %s", err)
 	}
 
-	// Get a list of all of the droplets and filter out any irrelevant ones
-	var workerDroplets, allDroplets []godo.Droplet
-	if allDroplets, _, err = client.Droplets.List(&godo.ListOptions{
-		PerPage: 200,
-	}); err != nil {
-		utils.Die("Error getting the list of droplets: %s", err)
+	switch workerConfig.Address {
+	case "", addressPublic, addressPrivate:
+	default:
+		return nil, fmt.Errorf("unknown address '%s', expected public or private", workerConfig.Address)
 	}
 
-	for _, droplet := range allDroplets {
-		if _, contains := workerSet[droplet.Name]; contains {
-			workerDroplets = append(workerDroplets, droplet)
+	// The config file is optional for load balancers that aren't configured through one
+	var file *configFile
+	if balanceConfigTemplate != "" {
+		if file, err = newConfigFile(balanceConfigTemplate, balanceConfigFile, command, workerConfig.ConfigFile); err != nil {
+			return nil, err
 		}
 	}
 
-	// Wrap the droplets for easier access to relevant information (public and private IP)
+	var loadBalancer LoadBalancer
+	if loadBalancer, err = newLoadBalancer(workerConfig, provider, file); err != nil {
+		return nil, err
+	}
+
+	var victimSelector VictimSelector
+	if victimSelector, err = newVictimSelector(workerConfig, sessionCounts(loadBalancer)); err != nil {
+		return nil, err
+	}
+
+	var weightStrategy WeightStrategy
+	if weightStrategy, err = newWeightStrategy(&workerConfig.Weights, overloadedCpuThreshold); err != nil {
+		return nil, err
+	}
+	weightInterval := time.Duration(workerConfig.Weights.Interval) * time.Second
+	if weightInterval <= 0 {
+		weightInterval = defaultWeightInterval
+	}
+
+	schedule, err := NewSchedule(workerConfig.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	var forecaster *Forecaster
+	if workerConfig.Forecast.Season != "" {
+		if forecaster, err = NewForecaster(workerConfig.Forecast, overloadedCpuThreshold, underusedCpuThreshold); err != nil {
+			return nil, err
+		}
+	}
+
+	history := NewMetricHistory(workerConfig.Policy.HistorySize)
+	var policy ScalingPolicy
+	if policy, err = newScalingPolicy(&workerConfig.Policy, overloadedCpuThreshold, underusedCpuThreshold, history); err != nil {
+		return nil, err
+	}
+
+	maxSurge := workerConfig.MaxSurge
+	if maxSurge <= 0 {
+		maxSurge = 1
+	}
+
+	reconcileInterval := time.Duration(workerConfig.ReconcileInterval) * time.Second
+	if workerConfig.ReconcileInterval == 0 {
+		reconcileInterval = defaultReconcileInterval
+	}
+
+	masterAddr := workerConfig.Launch.MasterAddr
+	if masterAddr == "" {
+		masterAddr = host
+	}
+
+	// Find the existing workers, either configured by name or carrying the worker tag
+	var workerInstances []Instance
+	if workerInstances, err = discoverInstances(provider, workerConfig); err != nil {
+		return nil, err
+	}
+
+	// Wrap the instances for easier access to relevant information (public and private IP).
+	// Droplets that are still booting or are powered off are left for reconciliation to pick up
+	// once they're active
 	var workers []*Worker
-	for _, droplet := range workerDroplets {
-		workers = append(workers, newWorker(droplet))
+	for _, instance := range workerInstances {
+		if instance.Status != InstanceActive {
+			fmt.Printf("Skipping %s for now: droplet status is '%s'\n", instance.Name, instance.Status)
+			continue
+		}
+		workers = append(workers, newWorker(instance, provider))
 	}
 
-	return &Master{
-		url:                    bindUrl,
+	m := &Master{
+		name:                   workerConfig.Name,
 		scaleNodes:             scaleNodes,
 		changeWeights:          changeWeights,
 		workerConfig:           workerConfig,
 		workers:                workers,
-		command:                command,
-		balanceConfigTemplate:  balanceConfigTemplate,
-		balanceConfigFile:      balanceConfigFile,
+		pending:                make(map[string]time.Time),
+		removing:               make(map[int]bool),
+		deleted:                make(map[int]time.Time),
 		overloadedCpuThreshold: overloadedCpuThreshold,
 		underusedCpuThreshold:  underusedCpuThreshold,
 		minWorkers:             minWorkers,
 		maxWorkers:             maxWorkers,
-		token:                  tokenSource,
-		imageID:                digitalOceanImageID,
-		doClient:               client,
+		masterAddr:             masterAddr,
+		userDataTemplate:       userDataTemplate,
+		victimSelector:         victimSelector,
+		weightStrategy:         weightStrategy,
+		weightInterval:         weightInterval,
+		policy:                 policy,
+		history:                history,
+		schedule:               schedule,
+		forecaster:             forecaster,
+		scaleOutDelay:          time.Duration(workerConfig.Policy.ScaleOutDelay) * time.Second,
+		scaleInDelay:           time.Duration(workerConfig.Policy.ScaleInDelay) * time.Second,
+		provider:               provider,
+		loadBalancer:           loadBalancer,
 		pollInterval:           pollInterval,
 		cooldownInterval:       cooldownInterval,
-		surveyDeadline:         surveyDeadline,
-		queryInterval:          queryInterval,
+		reconcileInterval:      reconcileInterval,
+		capacityCheckInterval:  defaultCapacityCheckInterval,
+		maxSurge:               maxSurge,
+		reports:                make(chan []*protocol.Report, 1),
+		commands:               make(chan controlRequest),
 	}
+	if file != nil {
+		file.fleet = m.fleetInfo
+	}
+	return m, nil
 }
 
-func NewMasterWithStatsd(host string, workerConfig *WorkerConfig, command, balanceConfigTemplate, balanceConfigFile, digitalOceanToken, digitalOceanImageID string,
-	overloadedCpuThreshold, underusedCpuThreshold float64, minWorkers, maxWorkers int64, pollInterval, cooldownInterval, surveyDeadline, queryInterval time.Duration,
+func NewMasterWithStatsd(host string, workerConfig *WorkerConfig, provider Provider, command, balanceConfigTemplate, balanceConfigFile, imageID string,
+	overloadedCpuThreshold, underusedCpuThreshold float64, minWorkers, maxWorkers int64, pollInterval, cooldownInterval time.Duration,
 	scaleNodes, changeWeights bool,
-	statsdAddr, statsdPrefix string, statsdInterval time.Duration) *Master {
+	statsdAddr, statsdPrefix string, statsdInterval time.Duration) (*Master, error) {
 
-	master := NewMaster(
-		host, workerConfig, command,
-		balanceConfigTemplate, balanceConfigFile,
-		digitalOceanToken, digitalOceanImageID,
+	master, err := NewMaster(
+		host, workerConfig, provider, command,
+		balanceConfigTemplate, balanceConfigFile, imageID,
 		overloadedCpuThreshold, underusedCpuThreshold,
 		minWorkers, maxWorkers,
-		pollInterval, cooldownInterval, surveyDeadline, queryInterval,
+		pollInterval, cooldownInterval,
 		scaleNodes, changeWeights,
 	)
+	if err != nil {
+		return nil, err
+	}
+
 	statsdClient := statsd.NewStatsdClient(statsdAddr, statsdPrefix)
-	statsdClient.CreateSocket()
+	if err = statsdClient.CreateSocket(); err != nil {
+		return nil, fmt.Errorf("error creating statsd socket: %s", err)
+	}
 	master.statsdClientBuffer = statsd.NewStatsdBuffer(statsdInterval, statsdClient)
 
-	return master
+	return master, nil
 }
 
+// Outcome of an asynchronous attempt to add or remove a worker
+type workerChange struct {
+	name     string
+	instance *Instance
+	err      error
+}
+
+// Hold off scaling for the cooldown interval. The flag is set before returning so the next
+// decision can't slip in ahead of it
 func (m *Master) cooldown() {
+	m.lock.Lock()
 	m.coolingDown = true
-	time.Sleep(m.cooldownInterval)
-	m.coolingDown = false
+	m.lock.Unlock()
+
+	go func() {
+		time.Sleep(m.cooldownInterval)
+		m.lock.Lock()
+		m.coolingDown = false
+		m.lock.Unlock()
+	}()
 }
 
-func (m *Master) queryWorkers(c chan<- float64) {
-	var (
-		err  error
-		sock mangos.Socket
-	)
+func (m *Master) isCoolingDown() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.coolingDown
+}
 
-	// Try to get new "surveyor" socket
-	if sock, err = surveyor.NewSocket(); err != nil {
-		utils.Die("Can't get new surveyor socket: %s", err)
+// Ask the scaling policy how many workers there should be, keeping within the configured bounds
+func (m *Master) desiredCapacity(metrics MetricsSnapshot) int64 {
+	// Scheduled actions can override the limits, and hold the pool at a floor the policy can still
+	// scale above
+	minWorkers, maxWorkers, scheduled := m.schedule.Apply(metrics.Time, m.minWorkers, m.maxWorkers)
+	fleet := FleetState{int64(len(m.workers)), int64(len(m.pending)), minWorkers, maxWorkers}
+
+	desired := m.policy.DesiredCapacity(metrics, fleet)
+	if m.forecaster != nil {
+		m.forecaster.Record(metrics.Time, metrics.LoadAvg*float64(len(m.workers)))
 	}
-	defer sock.Close()
+	return m.constrainCapacity(metrics.Time, desired, minWorkers, maxWorkers, scheduled)
+}
 
-	sock.AddTransport(tcp.NewTransport())
+// Desired capacity without metrics to go on: the pool stays as it is, within the bounds and
+// subject to the schedule, forecast and override
+func (m *Master) boundedCapacity(now time.Time) int64 {
+	minWorkers, maxWorkers, scheduled := m.schedule.Apply(now, m.minWorkers, m.maxWorkers)
+	return m.constrainCapacity(now, int64(len(m.workers)), minWorkers, maxWorkers, scheduled)
+}
 
-	// Begin listening on the URL
-	if err = sock.Listen(m.url.String()); err != nil {
-		utils.Die("Can't listen on surveyor socket: %s", err.Error())
+// Raise a desired capacity to the forecast and the schedule's floor, let an operator's explicit
+// capacity replace it, and keep it within the bounds
+func (m *Master) constrainCapacity(now time.Time, desired, minWorkers, maxWorkers int64, scheduled *int64) int64 {
+	// Provision ahead of the predicted load, never below what's needed now
+	if m.forecaster != nil {
+		if forecast, ok := m.forecaster.Forecast(now); ok && forecast > desired {
+			fmt.Printf("Forecast needs %d workers\n", forecast)
+			desired = forecast
+		}
 	}
 
-	// Set "deadline" for the survey and a timeout for receiving responses
-	if err = sock.SetOption(mangos.OptionSurveyTime, m.surveyDeadline); err != nil {
-		utils.Die("SetOption(mangos.OptionSurveyTime): %s", err.Error())
+	if scheduled != nil && *scheduled > desired {
+		desired = *scheduled
 	}
-	if err = sock.SetOption(mangos.OptionRecvDeadline, m.surveyDeadline+(1*time.Second)); err != nil {
-		utils.Die("SetOption(mangos.OptionRecvDeadline): %s", err.Error())
+	// An operator's explicit capacity beats the policy, the forecast and the schedule's floor
+	if m.desiredOverride != nil {
+		desired = *m.desiredOverride
 	}
 
-	for {
-		fmt.Println("Sending master request")
-		if err = sock.Send([]byte("CPU")); err != nil {
-			utils.Die("Failed sending survey: %s", err.Error())
-		}
-
-		loadAvgs := []float64{}
-		for {
-			var msg []byte
-			if msg, err = sock.Recv(); err != nil {
-				break
-			}
-			parts := strings.Split(string(msg), ",")
-			if len(parts) != 2 {
-				continue
-			}
-
-			ip := parts[0]
-			loadAvgString := parts[1]
-
-			// Find the corresponding droplet
-			var worker *Worker
-			for _, w := range m.workers {
-				if w.privateAddr == ip {
-					worker = w
-					break
-				}
-			}
-			if worker == nil {
-				fmt.Printf("Message received from unknown worker '%s'. Skipping...\n", ip)
-				continue
-			}
+	if desired < minWorkers {
+		desired = minWorkers
+	}
+	if desired > maxWorkers {
+		desired = maxWorkers
+	}
+	m.lastDesired = desired
+	return desired
+}
 
-			var loadAvg float64
-			if loadAvg, err = strconv.ParseFloat(string(loadAvgString), 64); err != nil {
-				utils.Die("ParseFloat(): %s", err.Error())
-			}
+// Whether workers are currently being added or removed
+func (m *Master) changingWorkers() bool {
+	return len(m.pending) > 0 || len(m.removing) > 0
+}
 
-			// Set their load average and append this worker's load average to the list
-			worker.loadAvg = loadAvg
-			loadAvgs = append(loadAvgs, loadAvg)
-		}
+func (m *Master) shouldAddWorker(desired int64) bool {
+	return !m.changingWorkers() && !m.isCoolingDown() && desired > int64(len(m.workers)) &&
+		time.Since(m.lastScaleIn) >= m.scaleOutDelay
+}
 
-		// Compute the average loadAvg
-		var loadAvg float64
-		for _, avg := range loadAvgs {
-			loadAvg += avg
-		}
-		loadAvg /= float64(len(loadAvgs))
+// Start launching workers to bring the pool up to the desired capacity, limited by the max surge
+func (m *Master) addWorkers(desired int64, c chan<- workerChange) error {
+	count := desired - int64(len(m.workers)) - int64(len(m.pending))
+	if count > m.maxSurge {
+		count = m.maxSurge
+	}
+	return m.launchWorkers(count, c)
+}
 
-		// Send the load averages
-		if !math.IsNaN(loadAvg) {
-			c <- loadAvg
+// Start launching the given number of workers
+func (m *Master) launchWorkers(count int64, c chan<- workerChange) error {
+	for i := int64(0); i < count; i++ {
+		name, err := m.newWorkerName()
+		if err != nil {
+			return err
 		}
+		m.pending[name] = time.Now()
 
-		// Wait
-		time.Sleep(m.queryInterval)
+		fmt.Printf("Adding %s\n", name)
+		go m.addWorker(name, c)
 	}
+	return nil
 }
 
-func (m *Master) shouldAddWorker(loadAvg float64) bool {
-	return !m.waitingOnWorkerChange && !m.coolingDown && loadAvg > m.overloadedCpuThreshold && int64(len(m.workers)) < m.maxWorkers
-}
-
-func (m *Master) addWorker(c chan<- *godo.Droplet) {
+func (m *Master) addWorker(name string, c chan<- workerChange) {
 	var (
-		droplet *godo.Droplet
-		err     error
+		instance, latest *Instance
+		err              error
 	)
 
-	// TODO find a better way to dynamically name the workers, create using a snapshot
-	name := fmt.Sprintf("%s%d", m.workerConfig.NamePrefix, len(m.workers)+1)
-	createRequest := &godo.DropletCreateRequest{
-		Name:              name,
-		Region:            "tor1",
-		Size:              "512mb",
-		PrivateNetworking: true,
-		Image: godo.DropletCreateImage{
-			Slug: m.imageID,
-		},
+	createRequest, err := m.workerConfig.Launch.instanceRequest(name, m.userDataTemplate, userDataInfo{
+		Pool:       m.name,
+		NamePrefix: m.workerConfig.NamePrefix,
+		MasterAddr: m.masterAddr,
+	})
+	if err != nil {
+		c <- workerChange{name: name, err: err}
+		return
+	}
+
+	// Tag the worker so it can be found again after a restart
+	if m.workerConfig.Tag != "" {
+		createRequest.Tags = append(createRequest.Tags, m.workerConfig.Tag)
 	}
 
-	if droplet, _, err = m.doClient.Droplets.Create(createRequest); err != nil {
-		utils.Die("Couldn't create droplet: %s\n", err.Error())
+	if instance, err = m.provider.CreateInstance(createRequest); err != nil {
+		c <- workerChange{name: name, err: fmt.Errorf("couldn't create droplet %s: %s", name, err)}
+		return
 	}
 
 	for {
 		time.Sleep(m.pollInterval)
-		if droplet, _, _ = m.doClient.Droplets.Get(droplet.ID); droplet.Status == "active" {
+		if latest, err = m.provider.GetInstance(instance.ID); err != nil {
+			// The droplet may have been removed out from under us
+			if isPermanent(err) {
+				c <- workerChange{name: name, err: fmt.Errorf("couldn't poll droplet %s: %s", name, err)}
+				return
+			}
+			fmt.Printf("Error polling droplet %d: %s\n", instance.ID, err.Error())
+			continue
+		}
+
+		instance = latest
+		if instance.Status == InstanceActive {
 			break
 		}
 
-		fmt.Printf("Polling. Status: %s\n", droplet.Status)
+		fmt.Printf("Polling %s. Status: %s\n", name, instance.Status)
 	}
 
-	fmt.Println("Droplet creation complete")
+	fmt.Printf("Droplet %s creation complete\n", name)
 
-	c <- droplet
+	c <- workerChange{name: name, instance: instance}
 }
 
-func (m *Master) shouldRemoveWorker(loadAvg float64) bool {
-	return !m.waitingOnWorkerChange && !m.coolingDown && loadAvg < m.underusedCpuThreshold && int64(len(m.workers)) > m.minWorkers
+// Pick a name for a new worker that isn't used by any existing worker
+func (m *Master) newWorkerName() (string, error) {
+	taken := make(map[string]bool)
+	for _, worker := range m.workers {
+		taken[worker.instance.Name] = true
+	}
+	for name := range m.pending {
+		taken[name] = true
+	}
+	for _, name := range m.workerConfig.DropletNames {
+		taken[name] = true
+	}
+	return uniqueWorkerName(m.workerConfig.NamePrefix, taken)
 }
 
-func (m *Master) removeWorker(c chan<- bool) {
-	// TODO implement logic to remove a worker only after all requests have finished processing
+func (m *Master) shouldRemoveWorker(desired int64) bool {
+	return !m.changingWorkers() && !m.isCoolingDown() && desired < int64(len(m.workers)) &&
+		time.Since(m.lastScaleOut) >= m.scaleInDelay
+}
 
-	// Delete the last droplet
-	toDelete := m.workers[len(m.workers)-1]
-	if _, err := m.doClient.Droplets.Delete(toDelete.droplet.ID); err != nil {
-		utils.Die("Error deleting droplet: %s", err.Error())
-	}
+// Choose which worker to remove when scaling in, or nil if none can be removed
+func (m *Master) selectVictim() *Worker {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 
-	m.workers = m.workers[0 : len(m.workers)-1]
+	// Workers cordoned by an operator are left alone
+	var candidates []*Worker
+	for _, worker := range m.workers {
+		if !worker.draining && !worker.cordoned {
+			candidates = append(candidates, worker)
+		}
+	}
+	return m.victimSelector.SelectVictim(candidates)
+}
 
-	c <- true
+// Take a worker out of the load balancer and delete its droplet once it has drained
+func (m *Master) startRemoving(worker *Worker, drained chan<- drainResult) {
+	fmt.Printf("Removing %s\n", worker.instance.Name)
+	m.lastScaleIn = time.Now()
+	m.removing[worker.instance.ID] = true
+	m.lock.Lock()
+	worker.draining = true
+	m.lock.Unlock()
+	go m.drainWorker(worker, drained)
 }
 
-func (m *Master) writeConfigFile() {
-	var (
-		file *os.File
-		temp *template.Template
-		err  error
-	)
+// Take a drained worker out of the config and start deleting its droplet. A worker that couldn't
+// be drained is kept, and the scaling action counts as failed
+func (m *Master) finishDraining(result drainResult, c chan<- workerChange) {
+	worker := result.worker
+	if result.err != nil {
+		delete(m.removing, worker.instance.ID)
+		m.lock.Lock()
+		worker.draining = false
+		m.lock.Unlock()
+		m.emit(EventWorkerDrainFailed, worker, "%s", result.err.Error())
+		m.scalingFinished(result.err)
+		return
+	}
 
-	if temp, err = template.ParseFiles(m.balanceConfigTemplate); err != nil {
-		utils.Die("Error reading in template: %s", err.Error())
+	m.lock.Lock()
+	for i, w := range m.workers {
+		if w == worker {
+			m.workers = append(m.workers[:i], m.workers[i+1:]...)
+			break
+		}
 	}
-	if file, err = os.OpenFile(m.balanceConfigFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm); err != nil {
-		utils.Die("Error opening load balancer config file: %s", err.Error())
+	m.lock.Unlock()
+	m.updateLoadBalancer()
+
+	go m.removeWorker(worker, c)
+}
+
+// Delete a worker's droplet. The worker should already have been drained and taken out of the
+// load balancer's config
+func (m *Master) removeWorker(toDelete *Worker, c chan<- workerChange) {
+	if err := m.provider.DeleteInstance(toDelete.instance.ID); err != nil {
+		c <- workerChange{toDelete.instance.Name, &toDelete.instance, fmt.Errorf("error deleting droplet %s: %s", toDelete.instance.Name, err)}
+		return
 	}
 
-	// Get the IP addresses together
-	type haproxyInfo struct {
-		Addr   string
-		Weight int64
+	c <- workerChange{toDelete.instance.Name, &toDelete.instance, nil}
+}
+
+// Put the load balancer onto the current set of workers. On failure it keeps serving with its
+// previous configuration.
+func (m *Master) updateLoadBalancer() {
+	if err := m.loadBalancer.SetServers(m.backendServers()); err != nil {
+		fmt.Printf("Load balancer update failed: %s\n", err.Error())
 	}
-	ips := make(map[string]haproxyInfo)
+}
+
+func (m *Master) backendServers() []BackendServer {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	servers := make([]BackendServer, 0, len(m.workers))
 	for _, worker := range m.workers {
-		ips[worker.droplet.Name] = haproxyInfo{
-			worker.publicAddr,
-			worker.weight,
+		addr := worker.publicAddr
+		if m.workerConfig.Address == addressPrivate {
+			addr = worker.privateAddr
 		}
+		servers = append(servers, BackendServer{
+			Name:        worker.instance.Name,
+			ID:          worker.instance.ID,
+			Addr:        addr,
+			PublicAddr:  worker.publicAddr,
+			PrivateAddr: worker.privateAddr,
+			Region:      worker.instance.Region,
+			Size:        worker.instance.Size,
+			Tags:        worker.instance.Tags,
+			Weight:      worker.weight,
+			Draining:    worker.draining || worker.cordoned,
+		})
 	}
+	return servers
+}
 
-	// Print out all of the objects
-	fmt.Printf("Writing out new config for %d workers\n", len(m.workers))
-	for key, ip := range ips {
-		fmt.Printf("%s: ip=%s, weight=%d\n", key, ip.Addr, ip.Weight)
+// The pool as a whole, for load balancer config templates
+func (m *Master) fleetInfo() FleetInfo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	info := FleetInfo{
+		Pool:         m.name,
+		NamePrefix:   m.workerConfig.NamePrefix,
+		Tag:          m.workerConfig.Tag,
+		LoadBalancer: m.workerConfig.LoadBalancer,
+		ListenPort:   m.workerConfig.ConfigFile.ListenPort,
+		Workers:      int64(len(m.workers)),
+		Min:          m.minWorkers,
+		Max:          m.maxWorkers,
+		LoadAvg:      m.currentLoadAvg,
+		Generated:    time.Now(),
 	}
-
-	// Write changes out to the template file
-	if err = temp.Execute(file, ips); err != nil {
-		utils.Die("Error writing template out to the file: %s", err.Error())
+	info.Backend, info.Port = templateBackend(m.workerConfig)
+	if info.ListenPort <= 0 {
+		info.ListenPort = defaultListenPort
 	}
+	for _, worker := range m.workers {
+		if worker.draining || worker.cordoned {
+			info.Draining++
+		}
+	}
+	return info
 }
 
-func (m *Master) reload() {
-	var (
-		out []byte
-		err error
-	)
+// Record the outcome of a scaling action, starting the cooldown once nothing else is in flight.
+// Failures put the master into degraded mode, in which the existing workers keep serving and
+// scaling is retried after the cooldown.
+func (m *Master) scalingFinished(err error) {
+	if !m.changingWorkers() {
+		m.cooldown()
+	}
 
-	if out, err = exec.Command("sh", "-c", m.command).Output(); err != nil {
-		utils.Die("Error executing 'reload' command: %s", err.Error())
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err != nil {
+		if !m.degraded {
+			fmt.Println("Entering degraded mode")
+		}
+		m.degraded = true
+		fmt.Printf("Scaling action failed: %s\n", err.Error())
+	} else if m.degraded {
+		fmt.Println("Leaving degraded mode")
+		m.degraded = false
 	}
-	fmt.Printf("Executed command. Output: '%s'\n", strings.TrimSpace(string(out)))
 }
 
 func (m *Master) streamStats() {
 	for {
+		m.lock.RLock()
 		m.statsdClientBuffer.Gauge("workers", int64(len(m.workers)))
 		m.statsdClientBuffer.FGauge("loadavg", m.currentLoadAvg)
+		if m.degraded {
+			m.statsdClientBuffer.Gauge("degraded", 1)
+		} else {
+			m.statsdClientBuffer.Gauge("degraded", 0)
+		}
 		for _, worker := range m.workers {
-			m.statsdClientBuffer.FGauge(fmt.Sprintf("%s-loadavg", worker.droplet.Name), worker.loadAvg)
-			m.statsdClientBuffer.Gauge(fmt.Sprintf("%s-weight", worker.droplet.Name), worker.weight)
+			m.statsdClientBuffer.FGauge(fmt.Sprintf("%s-loadavg", worker.instance.Name), worker.loadAvg)
+			m.statsdClientBuffer.Gauge(fmt.Sprintf("%s-weight", worker.instance.Name), worker.weight)
 		}
+		m.lock.RUnlock()
 
 		fmt.Println("Streamed to statsd")
 		time.Sleep(time.Second * 5)
@@ -379,60 +616,89 @@ func (m *Master) streamStats() {
 
 func (m *Master) updateWeights() {
 	for {
+		// Weight updates can be paused through the control API
+		m.lock.RLock()
+		enabled := m.changeWeights
+		m.lock.RUnlock()
+		if !enabled {
+			time.Sleep(m.weightInterval)
+			continue
+		}
+
 		fmt.Println("Updating weights...")
 
-		var cmd string
-		var sockconfig string
-		sockconfig = "/etc/haproxy/haproxy.sock"
+		// Gather what the strategy needs, leaving draining and cordoned workers alone so they don't
+		// pick up new sessions
+		var inputs []WeightInput
+		m.lock.RLock()
+		for _, worker := range m.workers {
+			if !worker.draining && !worker.cordoned {
+				inputs = append(inputs, WeightInput{worker.instance.Name, worker.loadAvg, worker.metrics, worker.lbStats})
+			}
+		}
+		m.lock.RUnlock()
 
 		// Calculate the new weights
+		weights := m.weightStrategy.Weights(inputs)
+		m.lock.Lock()
 		for _, worker := range m.workers {
-			avg := worker.loadAvg
-			maxLoad := m.overloadedCpuThreshold
-			if avg < 0.001 {
-				avg = 0.001
+			if weight, ok := weights[worker.instance.Name]; ok {
+				worker.weight = weight
 			}
-			if avg > maxLoad {
-				avg = maxLoad
-			}
-
-			// Calculate the worker's weight
-			weight := int64(((255 / maxLoad) * ((maxLoad + 0.001) - avg)) + 1)
-			worker.weight = weight
+		}
+		m.lock.Unlock()
 
-			// Compose the command
-			weightString := strconv.FormatInt(weight, 10)
-			s := []string{"set", "weight", fmt.Sprintf("nodes/%s", worker.droplet.Name), weightString}
-			cmd = "'" + strings.Join(s, " ") + "'"
-			str := []string{"echo", cmd, "|", "socat", "stdio", sockconfig}
+		for _, err := range m.loadBalancer.SetWeights(weights) {
+			fmt.Printf("Error setting weight: %s\n", err.Error())
+		}
+		time.Sleep(m.weightInterval)
+	}
+}
 
-			var finalCMD string
-			finalCMD = strings.Join(str, " ")
+// Compare the pool to the desired capacity and start adding or removing workers to match
+func (m *Master) scale(metrics MetricsSnapshot, created chan<- workerChange, drained chan<- drainResult) {
+	m.scaleTo(m.desiredCapacity(metrics), created, drained)
+}
 
-			// Execute the command
-			_, err := exec.Command("sh", "-c", finalCMD).Output()
-			if err != nil {
-				fmt.Printf("Error writing weight to socket: %s\n", err.Error())
-			}
+// Start adding or removing workers to reach a desired capacity
+func (m *Master) scaleTo(desired int64, created chan<- workerChange, drained chan<- drainResult) {
+	if m.shouldAddWorker(desired) {
+		fmt.Printf("Scaling out pool %s (desired capacity %d)\n", m.name, desired)
+		m.lastScaleOut = time.Now()
+		if err := m.addWorkers(desired, created); err != nil {
+			m.scalingFinished(err)
 		}
-		time.Sleep(time.Second * 20)
+	} else if m.shouldRemoveWorker(desired) {
+		fmt.Printf("Scaling in pool %s (desired capacity %d)\n", m.name, desired)
+		toDelete := m.selectVictim()
+		if toDelete == nil {
+			fmt.Println("No workers can be removed")
+			return
+		}
+
+		// Drain the worker before deleting it
+		m.startRemoving(toDelete, drained)
 	}
 }
 
-func (m *Master) MonitorWorkers() {
-	// Send out survey requests indefinitely
-	workerQuery := make(chan float64)
-	dropletCreatePoll := make(chan *godo.Droplet)
-	dropletDeletePoll := make(chan bool)
-
-	// Write an initial config file
-	m.writeConfigFile()
-	m.reload()
-	// Start querying the worker threads
-	go m.queryWorkers(workerQuery)
-	// Start the goroutine to update weights
-	if m.changeWeights {
-		go m.updateWeights()
+// Manage the pool, scaling it on the metrics the surveyor passes on
+func (m *Master) monitor() {
+	workerQuery := make(chan MetricsSnapshot)
+	dropletCreatePoll := make(chan workerChange)
+	dropletDeletePoll := make(chan workerChange)
+	drained := make(chan drainResult)
+	reconcileResults := make(chan reconcileSnapshot)
+
+	// Put the initial workers behind the load balancer
+	m.updateLoadBalancer()
+	// Start handling the workers' survey responses
+	go m.handleReports(workerQuery)
+	// Start the goroutine to update weights, which idles while they're turned off
+	go m.updateWeights()
+
+	// Start reconciling the worker set against the provider
+	if m.reconcileInterval > 0 {
+		go m.reconcileWorkers(reconcileResults)
 	}
 
 	// Start streaming stats if needed
@@ -440,51 +706,125 @@ func (m *Master) MonitorWorkers() {
 		go m.streamStats()
 	}
 
+	// Surveys only carry metrics when workers answer, so the limits are also enforced on a timer
+	// for pools that are empty or not reporting
+	capacityCheck := time.NewTicker(m.capacityCheckInterval)
+	defer capacityCheck.Stop()
+	var lastMetrics time.Time
+
 	for {
 		select {
-		case loadAvg := <-workerQuery:
-			fmt.Printf("Load avg: %f\n", loadAvg)
-			m.currentLoadAvg = loadAvg
+		case metrics := <-workerQuery:
+			lastMetrics = metrics.Time
+			fmt.Printf("Pool %s load avg: %f\n", m.name, metrics.LoadAvg)
+			m.lock.Lock()
+			m.currentLoadAvg = metrics.LoadAvg
+			m.lock.Unlock()
+			m.history.Record(metrics)
 
 			// Make scaling decision
 			if m.scaleNodes {
-				if m.shouldAddWorker(loadAvg) {
-					fmt.Println("Max threshold met")
-					m.waitingOnWorkerChange = true
-					go m.addWorker(dropletCreatePoll)
-				} else if m.shouldRemoveWorker(loadAvg) {
-					fmt.Println("Min threshold met")
-					m.waitingOnWorkerChange = true
-					go m.removeWorker(dropletDeletePoll)
-				}
+				m.scale(metrics, dropletCreatePoll, drained)
 			}
 
-		case newDroplet := <-dropletCreatePoll:
-			go m.cooldown()
-			m.waitingOnWorkerChange = false
+		case now := <-capacityCheck.C:
+			if m.scaleNodes && now.Sub(lastMetrics) >= m.capacityCheckInterval {
+				m.scaleTo(m.boundedCapacity(now), dropletCreatePoll, drained)
+			}
 
-			// Add the new droplet to the list
-			m.workers = append(m.workers, newWorker(*newDroplet))
+		case change := <-dropletCreatePoll:
+			delete(m.pending, change.name)
+			m.scalingFinished(change.err)
+			if change.err != nil {
+				continue
+			}
+
+			// Add the new droplet to the list, unless reconciliation already picked it up
+			m.lock.Lock()
+			if m.findWorker(change.instance.ID) == nil {
+				m.workers = append(m.workers, newWorker(*change.instance, m.provider))
+			}
+			m.lock.Unlock()
 
 			// Write it to the config file and execute the "reload" command
-			m.writeConfigFile()
-			m.reload()
+			m.updateLoadBalancer()
 
-		case <-dropletDeletePoll:
-			go m.cooldown()
-			m.waitingOnWorkerChange = false
-			m.writeConfigFile()
-			m.reload()
+		case result := <-drained:
+			m.finishDraining(result, dropletDeletePoll)
+
+		case change := <-dropletDeletePoll:
+			delete(m.removing, change.instance.ID)
+			m.scalingFinished(change.err)
+			if change.err == nil {
+				m.deleted[change.instance.ID] = time.Now()
+			}
+
+		case snapshot := <-reconcileResults:
+			if m.reconcile(snapshot) {
+				m.updateLoadBalancer()
+			}
 
+		case request := <-m.commands:
+			request.done <- request.apply(loopChannels{dropletCreatePoll, drained})
+
+		}
+	}
+}
+
+// Must be called with the lock held
+func (m *Master) findWorker(id int) *Worker {
+	for _, worker := range m.workers {
+		if worker.instance.ID == id {
+			return worker
 		}
 	}
+	return nil
 }
 
 func (m *Master) CleanUp() {
-	m.statsdClientBuffer.Close()
+	if m.statsdClientBuffer != nil {
+		m.statsdClientBuffer.Close()
+	}
 }
 
 type WorkerConfig struct {
-	NamePrefix   string   `json:"namePrefix"`
-	DropletNames []string `json:"dropletNames"`
+	// Name of the pool, which its workers announce in their survey responses
+	Name       string `json:"name"`
+	NamePrefix string `json:"namePrefix"`
+	// Tag identifying the pool's droplets. New workers are tagged with it automatically
+	Tag string `json:"tag"`
+	// Statically configured droplets that are part of the pool whether or not they are tagged
+	DropletNames []string       `json:"dropletNames"`
+	Launch       LaunchTemplate `json:"launch"`
+	Drain        DrainConfig    `json:"drain"`
+	// Which of the workers' addresses the load balancer uses: "public" (the default) or "private"
+	Address string `json:"address"`
+	// Load balancer the workers go behind: "haproxy" (the default), "nginx", "envoy" or "digitalocean"
+	LoadBalancer             string                         `json:"loadBalancer"`
+	HAProxy                  HAProxyConfig                  `json:"haproxy"`
+	Nginx                    NginxConfig                    `json:"nginx"`
+	Envoy                    EnvoyConfig                    `json:"envoy"`
+	DigitalOceanLoadBalancer DigitalOceanLoadBalancerConfig `json:"digitalOceanLoadBalancer"`
+	Weights                  WeightConfig                   `json:"weights"`
+	// Checking and versioning of the load balancer config file
+	ConfigFile ConfigFileConfig `json:"configFile"`
+	// Which worker to remove when scaling in: "newest" (the default), "oldest", "least-loaded"
+	// or "least-connections"
+	VictimSelection string `json:"victimSelection"`
+	// Never remove the droplets listed in dropletNames
+	ProtectBaseline bool         `json:"protectBaseline"`
+	Policy          PolicyConfig `json:"policy"`
+	// The pool's own bounds, thresholds and cooldown (in seconds), in place of the -min, -max,
+	// -overloaded, -underused and -cooldowninterval flags
+	Min        int64   `json:"min"`
+	Max        int64   `json:"max"`
+	Overloaded float64 `json:"overloaded"`
+	Underused  float64 `json:"underused"`
+	Cooldown   int64   `json:"cooldown"`
+	// Maximum number of workers to launch at once when scaling out. Defaults to 1
+	MaxSurge int64 `json:"maxSurge"`
+	// How often (in seconds) to check the worker set against the provider. Defaults to 60, negative disables
+	ReconcileInterval int64             `json:"reconcileInterval"`
+	Schedule          []ScheduledAction `json:"schedule"`
+	Forecast          ForecastConfig    `json:"forecast"`
 }
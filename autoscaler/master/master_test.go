@@ -0,0 +1,291 @@
+package master
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestScale(t *testing.T) {
+	tests := []struct {
+		name        string
+		workers     int
+		pending     int
+		loadAvg     float64
+		coolingDown bool
+		// How long ago the pool last scaled, and the delays before scaling the other way
+		sinceScaleOut, sinceScaleIn time.Duration
+		scaleOutDelay, scaleInDelay time.Duration
+		maxSurge                    int64
+		policy                      PolicyConfig
+		wantAdded, wantRemoved      int
+	}{
+		{name: "overloaded adds a worker", workers: 2, loadAvg: 0.9, wantAdded: 1},
+		{name: "underused removes a worker", workers: 3, loadAvg: 0.1, wantRemoved: 1},
+		{name: "within thresholds", workers: 3, loadAvg: 0.4},
+		{name: "overloaded at max", workers: 5, loadAvg: 0.9},
+		{name: "underused at min", workers: 1, loadAvg: 0.1},
+		{name: "cooling down holds off scaling out", workers: 2, loadAvg: 0.9, coolingDown: true},
+		{name: "cooling down holds off scaling in", workers: 3, loadAvg: 0.1, coolingDown: true},
+		{name: "launch in flight", workers: 2, pending: 1, loadAvg: 0.9},
+		{
+			name: "scale-out delay after scaling in", workers: 2, loadAvg: 0.9,
+			sinceScaleIn: time.Minute, scaleOutDelay: 5 * time.Minute,
+		},
+		{
+			name: "scale-out delay has passed", workers: 2, loadAvg: 0.9,
+			sinceScaleIn: 10 * time.Minute, scaleOutDelay: 5 * time.Minute, wantAdded: 1,
+		},
+		{
+			name: "scale-in delay after scaling out", workers: 3, loadAvg: 0.1,
+			sinceScaleOut: time.Minute, scaleInDelay: 5 * time.Minute,
+		},
+		{
+			name: "surge limited by max surge", workers: 1, loadAvg: 0.9, maxSurge: 2, wantAdded: 2,
+			policy: PolicyConfig{Type: "step", ScaleOutSteps: []Step{{LowerBound: 0, Adjustment: 3}}},
+		},
+		{
+			name: "surge limited by max", workers: 4, loadAvg: 0.9, maxSurge: 3, wantAdded: 1,
+			policy: PolicyConfig{Type: "step", ScaleOutSteps: []Step{{LowerBound: 0, Adjustment: 3}}},
+		},
+		{
+			name: "sustained breach not yet reached", workers: 2, loadAvg: 0.9,
+			policy: PolicyConfig{ScaleOutWindow: EvaluationWindow{Datapoints: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider()
+			m, loadBalancer := newTestMaster(t, provider, &WorkerConfig{
+				NamePrefix: "web",
+				Tag:        "web",
+				MaxSurge:   test.maxSurge,
+				Policy:     test.policy,
+			})
+			for i := 0; i < test.workers; i++ {
+				// Give each worker a distinct age so the newest is removed first
+				instance := provider.add(fmt.Sprintf("web-%d", i), InstanceActive, time.Duration(test.workers-i)*time.Hour, "web")
+				m.workers = append(m.workers, newWorker(instance, provider))
+			}
+			for i := 0; i < test.pending; i++ {
+				m.pending[fmt.Sprintf("web-pending-%d", i)] = time.Now()
+			}
+			m.coolingDown = test.coolingDown
+			m.scaleOutDelay, m.scaleInDelay = test.scaleOutDelay, test.scaleInDelay
+			if test.sinceScaleOut > 0 {
+				m.lastScaleOut = time.Now().Add(-test.sinceScaleOut)
+			}
+			if test.sinceScaleIn > 0 {
+				m.lastScaleIn = time.Now().Add(-test.sinceScaleIn)
+			}
+
+			created := make(chan workerChange, 10)
+			drained := make(chan drainResult, 10)
+			m.scale(MetricsSnapshot{Time: time.Now(), LoadAvg: test.loadAvg}, created, drained)
+
+			for i := 0; i < test.wantAdded; i++ {
+				select {
+				case change := <-created:
+					if change.err != nil {
+						t.Fatalf("adding %s: %s", change.name, change.err)
+					}
+					if !change.instance.HasTag("web") {
+						t.Errorf("%s wasn't tagged with the pool's tag", change.name)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("only %d of %d workers were added", i, test.wantAdded)
+				}
+			}
+			if added := provider.createdCount(); added != test.wantAdded {
+				t.Errorf("added %d workers, want %d", added, test.wantAdded)
+			}
+
+			if removing := len(m.removing); removing != test.wantRemoved {
+				t.Fatalf("removing %d workers, want %d", removing, test.wantRemoved)
+			}
+			if test.wantRemoved > 0 {
+				select {
+				case result := <-drained:
+					worker := result.worker
+					if result.err != nil {
+						t.Fatal(result.err)
+					}
+					if want := fmt.Sprintf("web-%d", test.workers-1); worker.instance.Name != want {
+						t.Errorf("removed %s, want the newest worker %s", worker.instance.Name, want)
+					}
+					if len(loadBalancer.drained) != 1 {
+						t.Errorf("drained %v at the load balancer, want one worker", loadBalancer.drained)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("worker was never drained")
+				}
+			}
+		})
+	}
+}
+
+func TestScalingFinished(t *testing.T) {
+	m, _ := newTestMaster(t, newFakeProvider(), &WorkerConfig{NamePrefix: "web"})
+	m.cooldownInterval = 20 * time.Millisecond
+
+	// Read the shared state meanwhile, as the stats stream and control API do
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				m.fleetInfo()
+				m.lock.RLock()
+				_, _ = m.coolingDown, m.degraded
+				m.lock.RUnlock()
+			}
+		}
+	}()
+
+	m.scalingFinished(fmt.Errorf("couldn't create droplet"))
+	m.lock.RLock()
+	degraded := m.degraded
+	m.lock.RUnlock()
+	if !m.isCoolingDown() || !degraded {
+		t.Fatalf("cooling down %t, degraded %t after a failure, want both", m.isCoolingDown(), degraded)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if m.isCoolingDown() {
+		t.Error("still cooling down after the interval")
+	}
+
+	// Nothing is in flight, so a success ends degraded mode and starts another cooldown
+	m.scalingFinished(nil)
+	m.lock.RLock()
+	degraded = m.degraded
+	m.lock.RUnlock()
+	if !m.isCoolingDown() || degraded {
+		t.Errorf("cooling down %t, degraded %t after a success", m.isCoolingDown(), degraded)
+	}
+}
+
+func TestDesiredCapacitySchedule(t *testing.T) {
+	scheduled := int64(3)
+	tests := []struct {
+		name     string
+		workers  int
+		loadAvg  float64
+		override int64
+		want     int64
+	}{
+		{name: "schedule raises the policy's decision", workers: 2, loadAvg: 0.4, want: 3},
+		{name: "schedule holds off scaling in", workers: 3, loadAvg: 0.1, want: 3},
+		{name: "policy scales above the schedule", workers: 3, loadAvg: 0.9, want: 4},
+		{name: "override takes precedence", workers: 3, loadAvg: 0.9, override: 1, want: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider()
+			m, _ := newTestMaster(t, provider, &WorkerConfig{
+				NamePrefix: "web",
+				Schedule:   []ScheduledAction{{Name: "always", Cron: "* * * * *", Desired: &scheduled}},
+			})
+			for i := 0; i < test.workers; i++ {
+				instance := provider.add(fmt.Sprintf("web-%d", i), InstanceActive, time.Hour)
+				m.workers = append(m.workers, newWorker(instance, provider))
+			}
+			if test.override > 0 {
+				m.desiredOverride = &test.override
+			}
+
+			if desired := m.desiredCapacity(MetricsSnapshot{Time: time.Now(), LoadAvg: test.loadAvg}); desired != test.want {
+				t.Errorf("desired %d, want %d", desired, test.want)
+			}
+		})
+	}
+}
+
+func TestEmptyPoolLaunchesMin(t *testing.T) {
+	provider := newFakeProvider()
+	m, _ := newTestMaster(t, provider, &WorkerConfig{NamePrefix: "web", MaxSurge: 3})
+	m.minWorkers = 3
+	m.cooldownInterval = time.Millisecond
+	m.capacityCheckInterval = 5 * time.Millisecond
+
+	// No worker ever reports, so only the timer can scale the pool
+	go m.monitor()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.lock.RLock()
+		workers := len(m.workers)
+		m.lock.RUnlock()
+		if workers == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d workers, want the minimum of 3", workers)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if created := provider.createdCount(); created != 3 {
+		t.Errorf("launched %d workers, want 3", created)
+	}
+}
+
+func TestBoundedCapacity(t *testing.T) {
+	scheduled, override := int64(4), int64(2)
+	tests := []struct {
+		name     string
+		workers  int
+		schedule []ScheduledAction
+		override *int64
+		want     int64
+	}{
+		{name: "raised to min", workers: 0, want: 1},
+		{name: "kept as it is", workers: 3, want: 3},
+		{name: "lowered to max", workers: 7, want: 5},
+		{name: "raised to the schedule", workers: 1, schedule: []ScheduledAction{{Cron: "* * * * *", Desired: &scheduled}}, want: 4},
+		{name: "set by the override", workers: 4, override: &override, want: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider()
+			m, _ := newTestMaster(t, provider, &WorkerConfig{NamePrefix: "web", Schedule: test.schedule})
+			for i := 0; i < test.workers; i++ {
+				m.workers = append(m.workers, newWorker(provider.add(fmt.Sprintf("web-%d", i), InstanceActive, time.Hour), provider))
+			}
+			m.desiredOverride = test.override
+
+			if desired := m.boundedCapacity(time.Now()); desired != test.want {
+				t.Errorf("desired %d, want %d", desired, test.want)
+			}
+		})
+	}
+}
+
+func TestTemplateBackend(t *testing.T) {
+	tests := []struct {
+		config      WorkerConfig
+		wantBackend string
+		wantPort    int
+	}{
+		{WorkerConfig{}, "nodes", 80},
+		{WorkerConfig{LoadBalancer: "haproxy", HAProxy: HAProxyConfig{Backend: "api", Port: 8080}}, "api", 8080},
+		{WorkerConfig{LoadBalancer: "nginx", Nginx: NginxConfig{Upstream: "web", Port: 3000}}, "web", 3000},
+		{WorkerConfig{LoadBalancer: "nginx"}, "nodes", 80},
+		{WorkerConfig{LoadBalancer: "envoy"}, "", 0},
+	}
+	for _, test := range tests {
+		if backend, port := templateBackend(&test.config); backend != test.wantBackend || port != test.wantPort {
+			t.Errorf("%q: backend %q and port %d, want %q and %d", test.config.LoadBalancer, backend, port, test.wantBackend, test.wantPort)
+		}
+	}
+
+	m, _ := newTestMaster(t, newFakeProvider(), &WorkerConfig{NamePrefix: "web"})
+	if info := m.fleetInfo(); info.ListenPort != 80 {
+		t.Errorf("listen port %d, want the default of 80", info.ListenPort)
+	}
+}
@@ -0,0 +1,348 @@
+package master
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNginxUpstream = "nodes"
+	defaultNginxPort     = 80
+)
+
+// Where the workers go in nginx
+type NginxConfig struct {
+	// Upstream the workers are servers in. Defaults to "nodes"
+	Upstream string `json:"upstream"`
+	// Port the workers serve on. Defaults to 80
+	Port int `json:"port"`
+	// Base URL of the NGINX Plus API, e.g. "http://127.0.0.1:8080/api/6". When set, servers,
+	// weights and draining are changed through the API instead of reloading
+	API string `json:"api"`
+}
+
+// Puts the workers in an nginx upstream by rewriting its config and reloading, or through the
+// NGINX Plus API. Without the API, weights only take effect the next time the config is written
+type NginxLoadBalancer struct {
+	config NginxConfig
+	file   *configFile
+	client *http.Client
+
+	lock    sync.Mutex
+	servers []BackendServer
+	// Workers left out of the config while they drain, when there's no API
+	drained map[string]bool
+}
+
+// Server in an upstream, as the NGINX Plus API describes it
+type nginxServer struct {
+	ID     int    `json:"id,omitempty"`
+	Server string `json:"server"`
+	Weight int64  `json:"weight,omitempty"`
+	Drain  bool   `json:"drain,omitempty"`
+}
+
+func NewNginxLoadBalancer(config NginxConfig, file *configFile) *NginxLoadBalancer {
+	if config.Upstream == "" {
+		config.Upstream = defaultNginxUpstream
+	}
+	if config.Port <= 0 {
+		config.Port = defaultNginxPort
+	}
+	config.API = strings.TrimSuffix(config.API, "/")
+
+	return &NginxLoadBalancer{
+		config:  config,
+		file:    file,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		drained: make(map[string]bool),
+	}
+}
+
+func (n *NginxLoadBalancer) SetServers(servers []BackendServer) error {
+	n.lock.Lock()
+	n.servers = append([]BackendServer{}, servers...)
+	current := make(map[string]bool)
+	for _, server := range servers {
+		current[server.Name] = true
+	}
+	for name := range n.drained {
+		if !current[name] {
+			delete(n.drained, name)
+		}
+	}
+	n.lock.Unlock()
+
+	if err := n.file.write(n.configServers()); err != nil {
+		return err
+	}
+
+	if n.config.API != "" {
+		err := n.syncAPI(servers)
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("NGINX Plus API update failed, reloading instead: %s\n", err.Error())
+	}
+	return n.file.reload()
+}
+
+// Servers to write to the config, leaving out the ones being drained
+func (n *NginxLoadBalancer) configServers() []BackendServer {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	servers := make([]BackendServer, 0, len(n.servers))
+	for _, server := range n.servers {
+		if !n.drained[server.Name] {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+func (n *NginxLoadBalancer) address(server BackendServer) string {
+	return fmt.Sprintf("%s:%d", server.Addr, n.config.Port)
+}
+
+// Add and delete upstream servers through the API to match the workers
+func (n *NginxLoadBalancer) syncAPI(servers []BackendServer) error {
+	existing, err := n.listServers()
+	if err != nil {
+		return err
+	}
+
+	byAddress := make(map[string]nginxServer)
+	for _, server := range existing {
+		byAddress[server.Server] = server
+	}
+
+	wanted := make(map[string]bool)
+	for _, server := range servers {
+		address := n.address(server)
+		wanted[address] = true
+		if _, ok := byAddress[address]; !ok {
+			if err = n.request("POST", "/servers", nginxServer{Server: address, Weight: nginxWeight(server.Weight)}, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	for address, server := range byAddress {
+		if !wanted[address] {
+			if err = n.request("DELETE", fmt.Sprintf("/servers/%d", server.ID), nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nginx weights start at 1
+func nginxWeight(weight int64) int64 {
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+func (n *NginxLoadBalancer) SetWeights(weights map[string]int64) []error {
+	n.lock.Lock()
+	for i, server := range n.servers {
+		if weight, ok := weights[server.Name]; ok {
+			n.servers[i].Weight = weight
+		}
+	}
+	servers := append([]BackendServer{}, n.servers...)
+	n.lock.Unlock()
+
+	if n.config.API == "" {
+		return nil
+	}
+
+	existing, err := n.listServers()
+	if err != nil {
+		return []error{err}
+	}
+	ids := make(map[string]int)
+	for _, server := range existing {
+		ids[server.Server] = server.ID
+	}
+
+	var errs []error
+	for _, server := range servers {
+		weight, ok := weights[server.Name]
+		id, found := ids[n.address(server)]
+		if !ok || !found {
+			continue
+		}
+		if err = n.request("PATCH", fmt.Sprintf("/servers/%d", id), map[string]int64{"weight": nginxWeight(weight)}, nil); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", server.Name, err))
+		}
+	}
+	return errs
+}
+
+// Mark the server as draining through the API, or without one leave it out of the config and
+// reload, which lets the old nginx workers finish its open requests
+func (n *NginxLoadBalancer) Drain(name string) error {
+	server, ok := n.server(name)
+	if !ok {
+		return fmt.Errorf("unknown server %s", name)
+	}
+
+	if n.config.API != "" {
+		existing, err := n.listServers()
+		if err != nil {
+			return err
+		}
+		for _, upstream := range existing {
+			if upstream.Server == n.address(server) {
+				return n.request("PATCH", fmt.Sprintf("/servers/%d", upstream.ID), map[string]bool{"drain": true}, nil)
+			}
+		}
+		return fmt.Errorf("%s isn't in upstream %s", name, n.config.Upstream)
+	}
+
+	n.lock.Lock()
+	n.drained[name] = true
+	n.lock.Unlock()
+	if err := n.file.apply(n.configServers()); err != nil {
+		// The previous config is back in place, with the server still in it
+		n.lock.Lock()
+		delete(n.drained, name)
+		n.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Clear the server's drain flag through the API, or without one put it back in the config
+func (n *NginxLoadBalancer) Undrain(name string) error {
+	server, ok := n.server(name)
+	if !ok {
+		return fmt.Errorf("unknown server %s", name)
+	}
+
+	if n.config.API != "" {
+		existing, err := n.listServers()
+		if err != nil {
+			return err
+		}
+		for _, upstream := range existing {
+			if upstream.Server == n.address(server) {
+				return n.request("PATCH", fmt.Sprintf("/servers/%d", upstream.ID), map[string]bool{"drain": false}, nil)
+			}
+		}
+		return fmt.Errorf("%s isn't in upstream %s", name, n.config.Upstream)
+	}
+
+	n.lock.Lock()
+	delete(n.drained, name)
+	n.lock.Unlock()
+	if err := n.file.apply(n.configServers()); err != nil {
+		n.lock.Lock()
+		n.drained[name] = true
+		n.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Active connections to each server, from the API
+func (n *NginxLoadBalancer) Stats() (map[string]ServerStats, error) {
+	if n.config.API == "" {
+		return nil, errStatsUnsupported
+	}
+
+	var upstream struct {
+		Peers []struct {
+			Server       string  `json:"server"`
+			Active       int64   `json:"active"`
+			State        string  `json:"state"`
+			ResponseTime float64 `json:"response_time"`
+		} `json:"peers"`
+	}
+	if err := n.request("GET", "", nil, &upstream); err != nil {
+		return nil, err
+	}
+
+	n.lock.Lock()
+	names := make(map[string]string)
+	for _, server := range n.servers {
+		names[n.address(server)] = server.Name
+	}
+	n.lock.Unlock()
+
+	stats := make(map[string]ServerStats)
+	for _, peer := range upstream.Peers {
+		if name, ok := names[peer.Server]; ok {
+			stats[name] = ServerStats{Sessions: peer.Active, Status: peer.State, ResponseTime: peer.ResponseTime}
+		}
+	}
+	return stats, nil
+}
+
+func (n *NginxLoadBalancer) server(name string) (BackendServer, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, server := range n.servers {
+		if server.Name == name {
+			return server, true
+		}
+	}
+	return BackendServer{}, false
+}
+
+func (n *NginxLoadBalancer) listServers() ([]nginxServer, error) {
+	var servers []nginxServer
+	err := n.request("GET", "/servers", nil, &servers)
+	return servers, err
+}
+
+// Make a request to the upstream's part of the API, decoding the response into out if it's given
+func (n *NginxLoadBalancer) request(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	url := fmt.Sprintf("%s/http/upstreams/%s%s", n.config.API, n.config.Upstream, path)
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", method, url, err)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s (%s)", method, url, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		if err = json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("error parsing response from %s: %s", url, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package master
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNginxDrainWithoutAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	templatePath, path := filepath.Join(dir, "nginx.tmpl"), filepath.Join(dir, "nginx.conf")
+	if err = ioutil.WriteFile(templatePath, []byte("{{ range .Servers }}{{ .Name }} {{ end }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := newConfigFile(templatePath, path, "true", ConfigFileConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNginxLoadBalancer(NginxConfig{}, file)
+
+	check := func(step, want string, wantDrained bool) {
+		if got, _ := ioutil.ReadFile(path); string(got) != want {
+			t.Errorf("%s: config %q, want %q", step, got, want)
+		}
+		n.lock.Lock()
+		if n.drained["web-1"] != wantDrained {
+			t.Errorf("%s: web-1 drained %t, want %t", step, n.drained["web-1"], wantDrained)
+		}
+		n.lock.Unlock()
+	}
+
+	if err = n.SetServers([]BackendServer{{Name: "web-1"}, {Name: "web-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Drain("web-1"); err != nil {
+		t.Fatal(err)
+	}
+	check("drained", "web-2 ", true)
+	if err = n.Undrain("web-1"); err != nil {
+		t.Fatal(err)
+	}
+	check("undrained", "web-1 web-2 ", false)
+
+	// A drain nginx won't reload with leaves the server in rotation
+	file.command = "false"
+	if err = n.Drain("web-1"); err == nil {
+		t.Fatal("no error when the reload failed")
+	}
+	check("failed drain", "web-1 web-2 ", false)
+
+	file.command = "true"
+	if err = n.Drain("web-1"); err != nil {
+		t.Fatal(err)
+	}
+	file.command = "false"
+	if err = n.Undrain("web-1"); err == nil {
+		t.Fatal("no error when the reload failed")
+	}
+	check("failed undrain", "web-2 ", true)
+
+	// A removed worker's drain is forgotten
+	file.command = "true"
+	if err = n.SetServers([]BackendServer{{Name: "web-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	check("removed", "web-2 ", false)
+}
@@ -0,0 +1,218 @@
+package master
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Metrics gathered from one survey of the workers
+type MetricsSnapshot struct {
+	Time time.Time
+	// Mean load average across the workers that responded
+	LoadAvg float64
+	// Load average reported by each worker, keyed by name
+	Workers map[string]float64
+	// Every metric reported by each worker, keyed by worker name and then metric name
+	WorkerMetrics map[string]map[string]float64
+}
+
+// Current size and bounds of the worker pool
+type FleetState struct {
+	// Workers in service and workers still being launched
+	Current, Pending int64
+	Min, Max         int64
+}
+
+// Decides how many workers the pool should have
+type ScalingPolicy interface {
+	DesiredCapacity(metrics MetricsSnapshot, fleet FleetState) int64
+}
+
+// Adds or removes a single worker when the load crosses a threshold
+type ThresholdPolicy struct {
+	Overloaded, Underused float64
+}
+
+func (p *ThresholdPolicy) DesiredCapacity(metrics MetricsSnapshot, fleet FleetState) int64 {
+	if metrics.LoadAvg > p.Overloaded {
+		return fleet.Current + 1
+	} else if metrics.LoadAvg < p.Underused {
+		return fleet.Current - 1
+	}
+	return fleet.Current
+}
+
+// Adjustment applied when the breach of a threshold falls within [LowerBound, UpperBound). An
+// UpperBound of zero means there is no upper bound
+type Step struct {
+	LowerBound float64 `json:"lowerBound"`
+	UpperBound float64 `json:"upperBound"`
+	Adjustment int64   `json:"adjustment"`
+}
+
+// Adds or removes a number of workers depending on how far past a threshold the load is
+type StepPolicy struct {
+	Overloaded, Underused       float64
+	ScaleOutSteps, ScaleInSteps []Step
+}
+
+func (p *StepPolicy) DesiredCapacity(metrics MetricsSnapshot, fleet FleetState) int64 {
+	if metrics.LoadAvg > p.Overloaded {
+		return fleet.Current + stepAdjustment(p.ScaleOutSteps, metrics.LoadAvg-p.Overloaded)
+	} else if metrics.LoadAvg < p.Underused {
+		return fleet.Current - stepAdjustment(p.ScaleInSteps, p.Underused-metrics.LoadAvg)
+	}
+	return fleet.Current
+}
+
+func stepAdjustment(steps []Step, breach float64) int64 {
+	for _, step := range steps {
+		if breach >= step.LowerBound && (step.UpperBound == 0 || breach < step.UpperBound) {
+			return step.Adjustment
+		}
+	}
+	return 0
+}
+
+// Sizes the pool so the average load comes out at a target value
+type TargetTrackingPolicy struct {
+	Target float64
+}
+
+func (p *TargetTrackingPolicy) DesiredCapacity(metrics MetricsSnapshot, fleet FleetState) int64 {
+	if fleet.Current == 0 {
+		return fleet.Min
+	}
+	return int64(math.Ceil(float64(fleet.Current) * metrics.LoadAvg / p.Target))
+}
+
+// Requires a scaling decision to come up in Datapoints of the last Periods surveys
+type EvaluationWindow struct {
+	Datapoints int `json:"datapoints"`
+	Periods    int `json:"periods"`
+}
+
+// Fill in the defaults: a single datapoint, and as many periods as datapoints
+func (w EvaluationWindow) withDefaults() EvaluationWindow {
+	if w.Datapoints <= 0 {
+		w.Datapoints = 1
+	}
+	if w.Periods < w.Datapoints {
+		w.Periods = w.Datapoints
+	}
+	return w
+}
+
+// Wraps another policy, only passing on its decisions once they've been sustained over an
+// evaluation window. Scale-out and scale-in have separate windows
+type WindowedPolicy struct {
+	policy            ScalingPolicy
+	scaleOut, scaleIn EvaluationWindow
+	// Direction of each recent decision (1 out, -1 in, 0 neither), oldest first
+	decisions []int
+}
+
+func NewWindowedPolicy(policy ScalingPolicy, scaleOut, scaleIn EvaluationWindow) *WindowedPolicy {
+	return &WindowedPolicy{
+		policy:   policy,
+		scaleOut: scaleOut.withDefaults(),
+		scaleIn:  scaleIn.withDefaults(),
+	}
+}
+
+func (p *WindowedPolicy) DesiredCapacity(metrics MetricsSnapshot, fleet FleetState) int64 {
+	desired := p.policy.DesiredCapacity(metrics, fleet)
+
+	direction := 0
+	if desired > fleet.Current {
+		direction = 1
+	} else if desired < fleet.Current {
+		direction = -1
+	}
+
+	p.decisions = append(p.decisions, direction)
+	if max := maxInt(p.scaleOut.Periods, p.scaleIn.Periods); len(p.decisions) > max {
+		p.decisions = p.decisions[len(p.decisions)-max:]
+	}
+
+	window := p.scaleOut
+	if direction < 0 {
+		window = p.scaleIn
+	} else if direction == 0 {
+		return desired
+	}
+
+	agreeing := 0
+	for _, decision := range p.decisions[maxInt(0, len(p.decisions)-window.Periods):] {
+		if decision == direction {
+			agreeing++
+		}
+	}
+	if agreeing < window.Datapoints {
+		fmt.Printf("Waiting on a sustained breach (%d of %d datapoints)\n", agreeing, window.Datapoints)
+		return fleet.Current
+	}
+	return desired
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Scaling policy section of the worker config
+type PolicyConfig struct {
+	// "threshold" (the default), "step", "target-tracking" or "rules"
+	Type string `json:"type"`
+	// Steps for the step policy, measured from the -overloaded and -underused thresholds
+	ScaleOutSteps []Step `json:"scaleOutSteps"`
+	ScaleInSteps  []Step `json:"scaleInSteps"`
+	// Load average the target tracking policy aims for
+	Target float64 `json:"target"`
+	// Rules for the rules policy, and how many workers to add or remove when they're met
+	ScaleOutRules      []MetricRule `json:"scaleOutRules"`
+	ScaleInRules       []MetricRule `json:"scaleInRules"`
+	ScaleOutAdjustment int64        `json:"scaleOutAdjustment"`
+	ScaleInAdjustment  int64        `json:"scaleInAdjustment"`
+	// How long a policy's decision has to be sustained before it's acted on
+	ScaleOutWindow EvaluationWindow `json:"scaleOutWindow"`
+	ScaleInWindow  EvaluationWindow `json:"scaleInWindow"`
+	// Hysteresis: minimum time (in seconds) after scaling out before scaling in, and vice versa
+	ScaleInDelay  int64 `json:"scaleInDelay"`
+	ScaleOutDelay int64 `json:"scaleOutDelay"`
+	// Number of surveys to keep metric history for. Defaults to 1000
+	HistorySize int `json:"historySize"`
+}
+
+// Build the scaling policy described by the worker config, wrapped in its evaluation windows
+func newScalingPolicy(config *PolicyConfig, overloaded, underused float64, history *MetricHistory) (ScalingPolicy, error) {
+	policy, err := newBasePolicy(config, overloaded, underused, history)
+	if err != nil {
+		return nil, err
+	}
+	return NewWindowedPolicy(policy, config.ScaleOutWindow, config.ScaleInWindow), nil
+}
+
+func newBasePolicy(config *PolicyConfig, overloaded, underused float64, history *MetricHistory) (ScalingPolicy, error) {
+	switch config.Type {
+	case "", "threshold":
+		return &ThresholdPolicy{overloaded, underused}, nil
+	case "step":
+		if len(config.ScaleOutSteps) == 0 && len(config.ScaleInSteps) == 0 {
+			return nil, fmt.Errorf("step policy needs scaleOutSteps or scaleInSteps")
+		}
+		return &StepPolicy{overloaded, underused, config.ScaleOutSteps, config.ScaleInSteps}, nil
+	case "target-tracking":
+		if config.Target <= 0 {
+			return nil, fmt.Errorf("target tracking policy needs a positive target")
+		}
+		return &TargetTrackingPolicy{config.Target}, nil
+	case "rules":
+		return NewRulesPolicy(config.ScaleOutRules, config.ScaleInRules, config.ScaleOutAdjustment, config.ScaleInAdjustment, history)
+	default:
+		return nil, fmt.Errorf("unknown scaling policy '%s'", config.Type)
+	}
+}
@@ -0,0 +1,64 @@
+package master
+
+import "testing"
+
+func TestPolicies(t *testing.T) {
+	threshold := &ThresholdPolicy{Overloaded: 0.65, Underused: 0.2}
+	step := &StepPolicy{
+		Overloaded: 0.65, Underused: 0.2,
+		ScaleOutSteps: []Step{{LowerBound: 0, UpperBound: 0.2, Adjustment: 1}, {LowerBound: 0.2, Adjustment: 3}},
+		ScaleInSteps:  []Step{{LowerBound: 0, Adjustment: 1}},
+	}
+	target := &TargetTrackingPolicy{Target: 0.5}
+
+	tests := []struct {
+		name    string
+		policy  ScalingPolicy
+		loadAvg float64
+		current int64
+		want    int64
+	}{
+		{"threshold overloaded", threshold, 0.7, 3, 4},
+		{"threshold underused", threshold, 0.1, 3, 2},
+		{"threshold within", threshold, 0.4, 3, 3},
+		{"threshold at overloaded", threshold, 0.65, 3, 3},
+		{"step small breach", step, 0.7, 3, 4},
+		{"step large breach", step, 0.95, 3, 6},
+		{"step underused", step, 0.1, 3, 2},
+		{"target tracking up", target, 0.75, 4, 6},
+		{"target tracking down", target, 0.25, 4, 2},
+		{"target tracking empty pool", target, 0, 0, 1},
+	}
+
+	for _, test := range tests {
+		fleet := FleetState{Current: test.current, Min: 1, Max: 10}
+		if got := test.policy.DesiredCapacity(MetricsSnapshot{LoadAvg: test.loadAvg}, fleet); got != test.want {
+			t.Errorf("%s: desired %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWindowedPolicy(t *testing.T) {
+	policy := NewWindowedPolicy(&ThresholdPolicy{Overloaded: 0.65, Underused: 0.2},
+		EvaluationWindow{Datapoints: 2, Periods: 3}, EvaluationWindow{})
+	fleet := FleetState{Current: 3, Min: 1, Max: 10}
+
+	// Scale-out needs two breaches in the last three surveys, scale-in just one
+	for i, test := range []struct {
+		loadAvg float64
+		want    int64
+	}{
+		{0.9, 3},
+		{0.4, 3},
+		{0.9, 4},
+		{0.1, 2},
+		{0.4, 3},
+		{0.4, 3},
+		{0.9, 3},
+		{0.9, 4},
+	} {
+		if got := policy.DesiredCapacity(MetricsSnapshot{LoadAvg: test.loadAvg}, fleet); got != test.want {
+			t.Errorf("survey %d (load %.2f): desired %d, want %d", i+1, test.loadAvg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package master
+
+import (
+	"fmt"
+)
+
+// Name given to the pool of a config that doesn't list its pools
+const defaultPoolName = "default"
+
+// Top level of the worker config file. It describes either a single pool, with the pool's
+// settings at the top level, or several named pools under "pools"
+type Config struct {
+	WorkerConfig
+	Pools []*WorkerConfig `json:"pools"`
+}
+
+// The pools described by the config. Named pools must have distinct names, tags and name
+// prefixes, and their load balancer backends default to the pool's name
+func (c *Config) PoolConfigs() ([]*WorkerConfig, error) {
+	if len(c.Pools) == 0 {
+		if c.Name == "" {
+			c.Name = defaultPoolName
+		}
+		return []*WorkerConfig{&c.WorkerConfig}, nil
+	}
+
+	names := make(map[string]bool)
+	tags := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for _, pool := range c.Pools {
+		if pool.Name == "" {
+			return nil, fmt.Errorf("every pool needs a name")
+		}
+		if names[pool.Name] {
+			return nil, fmt.Errorf("more than one pool is named '%s'", pool.Name)
+		}
+		names[pool.Name] = true
+
+		if pool.Tag != "" {
+			if tags[pool.Tag] {
+				return nil, fmt.Errorf("pool %s: tag '%s' is used by another pool", pool.Name, pool.Tag)
+			}
+			tags[pool.Tag] = true
+		}
+		if prefixes[pool.NamePrefix] {
+			return nil, fmt.Errorf("pool %s: name prefix '%s' is used by another pool", pool.Name, pool.NamePrefix)
+		}
+		prefixes[pool.NamePrefix] = true
+
+		// Keep the pools' workers apart at the load balancer
+		if pool.HAProxy.Backend == "" {
+			pool.HAProxy.Backend = pool.Name
+		}
+		if pool.Nginx.Upstream == "" {
+			pool.Nginx.Upstream = pool.Name
+		}
+		if pool.Envoy.Cluster == "" {
+			pool.Envoy.Cluster = pool.Name
+		}
+	}
+	return c.Pools, nil
+}
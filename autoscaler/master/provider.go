@@ -0,0 +1,73 @@
+package master
+
+import "time"
+
+// Network address attached to an instance
+type NetworkAddress struct {
+	Type    string
+	Address string
+	Version int
+}
+
+// Type describing a single cloud instance, independent of the provider it came from
+type Instance struct {
+	ID       int
+	Name     string
+	Status   string
+	Region   string
+	Size     string
+	Tags     []string
+	Created  time.Time
+	Networks []NetworkAddress
+}
+
+// Parameters used when launching a new instance
+type InstanceRequest struct {
+	Name      string
+	Region    string
+	Size      string
+	ImageSlug string
+	ImageID   int
+	// Fingerprints of the SSH keys to install
+	SSHKeys           []string
+	Tags              []string
+	IPv6              bool
+	PrivateNetworking bool
+	VPCUUID           string
+	Monitoring        bool
+	UserData          string
+}
+
+// Provider is implemented by each cloud backend the master can manage workers on
+type Provider interface {
+	// List all of the instances visible to the provider
+	ListInstances() ([]Instance, error)
+	// List the instances carrying the given tag
+	ListInstancesByTag(tag string) ([]Instance, error)
+	// Launch a new instance. The returned instance may not be active yet
+	CreateInstance(request *InstanceRequest) (*Instance, error)
+	// Fetch the latest state of an instance
+	GetInstance(id int) (*Instance, error)
+	// Destroy an instance
+	DeleteInstance(id int) error
+	// Resolve the private and public addresses of an instance
+	Addresses(instance *Instance) (privateAddr, publicAddr string)
+	// List the instances behind one of the provider's load balancers
+	LoadBalancerInstances(id string) ([]int, error)
+	// Add instances to one of the provider's load balancers
+	AddToLoadBalancer(id string, instanceIDs ...int) error
+	// Remove instances from one of the provider's load balancers
+	RemoveFromLoadBalancer(id string, instanceIDs ...int) error
+}
+
+// Status reported by providers once an instance is ready to serve traffic
+const InstanceActive = "active"
+
+func (i *Instance) HasTag(tag string) bool {
+	for _, t := range i.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
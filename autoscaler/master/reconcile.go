@@ -0,0 +1,108 @@
+package master
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultReconcileInterval = 60 * time.Second
+
+	// How long a deleted droplet is kept from being adopted again if listings keep showing it.
+	// Digital Ocean deletes droplets asynchronously, so they can be listed for a while afterwards
+	deletedRetention = 30 * time.Minute
+)
+
+// The pool's droplets as listed at a point in time
+type reconcileSnapshot struct {
+	instances []Instance
+	listedAt  time.Time
+}
+
+// Periodically list the pool's droplets and hand them to the monitoring loop
+func (m *Master) reconcileWorkers(c chan<- reconcileSnapshot) {
+	for {
+		time.Sleep(m.reconcileInterval)
+
+		listedAt := time.Now()
+		instances, err := discoverInstances(m.provider, m.workerConfig)
+		if err != nil {
+			fmt.Printf("Error listing workers for reconciliation: %s\n", err.Error())
+			continue
+		}
+		c <- reconcileSnapshot{instances, listedAt}
+	}
+}
+
+// Bring the worker set in line with the droplets that actually exist. Droplets that are being
+// created or deleted by the master, or that changed since the snapshot was taken, are left alone.
+// Returns whether anything changed
+func (m *Master) reconcile(snapshot reconcileSnapshot) bool {
+	byID := make(map[int]Instance)
+	for _, instance := range snapshot.instances {
+		byID[instance.ID] = instance
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	changed := false
+	known := make(map[int]bool)
+	var workers []*Worker
+
+	for _, worker := range m.workers {
+		known[worker.instance.ID] = true
+		instance, exists := byID[worker.instance.ID]
+
+		if !exists {
+			if !m.removing[worker.instance.ID] && worker.joined.Before(snapshot.listedAt) {
+				m.emit(EventWorkerMissing, worker, "droplet no longer exists, removing it")
+				changed = true
+				continue
+			}
+		} else if instance.Status != InstanceActive {
+			m.emit(EventWorkerInactive, worker, "droplet status is '%s', removing it until it is active", instance.Status)
+			changed = true
+			continue
+		} else {
+			privateAddr, publicAddr := m.provider.Addresses(&instance)
+			if privateAddr != worker.privateAddr || publicAddr != worker.publicAddr {
+				m.emit(EventWorkerAddressChanged, worker, "addresses changed from %s/%s to %s/%s",
+					worker.privateAddr, worker.publicAddr, privateAddr, publicAddr)
+				worker.privateAddr, worker.publicAddr = privateAddr, publicAddr
+				changed = true
+			}
+			worker.instance = instance
+		}
+
+		workers = append(workers, worker)
+	}
+
+	for _, instance := range snapshot.instances {
+		_, pending := m.pending[instance.Name]
+		if known[instance.ID] || pending || m.removing[instance.ID] || instance.Status != InstanceActive {
+			continue
+		}
+		if _, deleted := m.deleted[instance.ID]; deleted {
+			continue
+		}
+
+		worker := newWorker(instance, m.provider)
+		m.emit(EventWorkerDiscovered, worker, "found active droplet, adding it")
+		workers = append(workers, worker)
+		changed = true
+	}
+
+	m.workers = workers
+
+	// Forget about a deletion once a listing taken after it no longer shows the droplet, or once
+	// it's been listed for too long to still be on its way out
+	for id, deletedAt := range m.deleted {
+		_, listed := byID[id]
+		if (!listed && deletedAt.Before(snapshot.listedAt)) || snapshot.listedAt.Sub(deletedAt) > deletedRetention {
+			delete(m.deleted, id)
+		}
+	}
+
+	return changed
+}
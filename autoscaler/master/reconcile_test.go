@@ -0,0 +1,61 @@
+package master
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReconcileDeletedDroplets(t *testing.T) {
+	provider := newFakeProvider()
+	m, _ := newTestMaster(t, provider, &WorkerConfig{NamePrefix: "web", Tag: "web"})
+	gone := provider.add("web-gone", InstanceActive, time.Hour, "web")
+
+	// The droplet is still listed after it was deleted
+	m.deleted[gone.ID] = time.Now().Add(-time.Minute)
+	if m.reconcile(reconcileSnapshot{[]Instance{gone}, time.Now()}) || len(m.workers) != 0 {
+		t.Fatalf("adopted %s while its deletion was in progress", gone.Name)
+	}
+	if _, ok := m.deleted[gone.ID]; !ok {
+		t.Fatal("forgot the deletion while the droplet was still listed")
+	}
+
+	// Once it's missing from a listing it's forgotten
+	m.reconcile(reconcileSnapshot{nil, time.Now()})
+	if _, ok := m.deleted[gone.ID]; ok {
+		t.Error("kept the deletion after the droplet disappeared")
+	}
+
+	// A droplet that's still listed long after it was deleted is adopted again
+	m.deleted[gone.ID] = time.Now().Add(-2 * deletedRetention)
+	m.reconcile(reconcileSnapshot{[]Instance{gone}, time.Now()})
+	if _, ok := m.deleted[gone.ID]; ok {
+		t.Error("kept the deletion past its retention")
+	}
+	m.reconcile(reconcileSnapshot{[]Instance{gone}, time.Now()})
+	if got := fmt.Sprint(workerNames(m.workers)); got != "[web-gone]" {
+		t.Errorf("workers %s, want the long-lived droplet adopted", got)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	provider := newFakeProvider()
+	m, _ := newTestMaster(t, provider, &WorkerConfig{NamePrefix: "web", Tag: "web"})
+
+	kept := provider.add("web-kept", InstanceActive, time.Hour, "web")
+	missing := provider.add("web-missing", InstanceActive, time.Hour, "web")
+	stopped := provider.add("web-stopped", InstanceActive, time.Hour, "web")
+	for _, instance := range []Instance{kept, missing, stopped} {
+		m.workers = append(m.workers, newWorker(instance, provider))
+	}
+	found := provider.add("web-found", InstanceActive, time.Minute, "web")
+	booting := provider.add("web-booting", "new", time.Minute, "web")
+	stopped.Status = "off"
+
+	if !m.reconcile(reconcileSnapshot{[]Instance{kept, stopped, found, booting}, time.Now()}) {
+		t.Fatal("reconcile reported no changes")
+	}
+	if got := fmt.Sprint(workerNames(m.workers)); got != "[web-found web-kept]" {
+		t.Errorf("workers %s", got)
+	}
+}
@@ -0,0 +1,187 @@
+package master
+
+import (
+	"fmt"
+	"time"
+)
+
+// Error that should not be retried (e.g. an invalid request)
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func isPermanent(err error) bool {
+	_, permanent := err.(*PermanentError)
+	return permanent
+}
+
+// Error for an instance or other resource the provider doesn't have. Providers return it wrapped
+// in a PermanentError
+type MissingError struct {
+	Err error
+}
+
+func (e *MissingError) Error() string {
+	return e.Err.Error()
+}
+
+func isMissing(err error) bool {
+	permanent, ok := err.(*PermanentError)
+	if !ok {
+		return false
+	}
+	_, missing := permanent.Err.(*MissingError)
+	return missing
+}
+
+// Policy controlling how failed provider calls are retried
+type RetryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Run fn until it succeeds, the attempts are used up or it returns a permanent error
+func (p RetryPolicy) Do(description string, fn func() error) error {
+	var err error
+	backoff := p.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || isPermanent(err) || attempt >= p.Attempts {
+			return err
+		}
+
+		fmt.Printf("%s failed (attempt %d/%d): %s. Retrying in %s\n", description, attempt, p.Attempts, err.Error(), backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// Provider wrapper that retries failed calls according to a RetryPolicy
+type RetryProvider struct {
+	provider Provider
+	policy   RetryPolicy
+}
+
+func NewRetryProvider(provider Provider, policy RetryPolicy) *RetryProvider {
+	return &RetryProvider{provider, policy}
+}
+
+func (p *RetryProvider) ListInstances() (instances []Instance, err error) {
+	err = p.policy.Do("Listing instances", func() error {
+		instances, err = p.provider.ListInstances()
+		return err
+	})
+	return instances, err
+}
+
+func (p *RetryProvider) ListInstancesByTag(tag string) (instances []Instance, err error) {
+	err = p.policy.Do(fmt.Sprintf("Listing instances tagged %s", tag), func() error {
+		instances, err = p.provider.ListInstancesByTag(tag)
+		return err
+	})
+	return instances, err
+}
+
+// Creating an instance isn't idempotent: a request that timed out or failed on the provider's side
+// may still have launched the instance. Before each retry, look for an instance with the requested
+// name and use it rather than launching a duplicate
+func (p *RetryProvider) CreateInstance(request *InstanceRequest) (instance *Instance, err error) {
+	var lastErr error
+	err = p.policy.Do(fmt.Sprintf("Creating instance %s", request.Name), func() error {
+		if lastErr != nil {
+			existing, lookupErr := p.findInstance(request)
+			if lookupErr != nil {
+				// Without knowing whether the last attempt went through, don't risk another
+				return &PermanentError{fmt.Errorf("%s (couldn't check whether it was created: %s)", lastErr, lookupErr)}
+			}
+			if existing != nil {
+				fmt.Printf("Instance %s was created despite the error\n", request.Name)
+				instance = existing
+				return nil
+			}
+		}
+
+		instance, lastErr = p.provider.CreateInstance(request)
+		return lastErr
+	})
+	return instance, err
+}
+
+// Find an instance launched for the request, by name among the instances carrying its tags
+func (p *RetryProvider) findInstance(request *InstanceRequest) (*Instance, error) {
+	var (
+		instances []Instance
+		err       error
+	)
+	if len(request.Tags) > 0 {
+		instances, err = p.provider.ListInstancesByTag(request.Tags[0])
+	} else {
+		instances, err = p.provider.ListInstances()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range instances {
+		if instances[i].Name == request.Name {
+			return &instances[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *RetryProvider) GetInstance(id int) (instance *Instance, err error) {
+	err = p.policy.Do(fmt.Sprintf("Getting instance %d", id), func() error {
+		instance, err = p.provider.GetInstance(id)
+		return err
+	})
+	return instance, err
+}
+
+// A delete that failed may still have gone through, so an instance that's missing by the time
+// the delete is retried counts as deleted
+func (p *RetryProvider) DeleteInstance(id int) error {
+	attempt := 0
+	return p.policy.Do(fmt.Sprintf("Deleting instance %d", id), func() error {
+		attempt++
+		err := p.provider.DeleteInstance(id)
+		if attempt > 1 && isMissing(err) {
+			fmt.Printf("Instance %d was deleted despite the error\n", id)
+			return nil
+		}
+		return err
+	})
+}
+
+func (p *RetryProvider) Addresses(instance *Instance) (privateAddr, publicAddr string) {
+	return p.provider.Addresses(instance)
+}
+
+func (p *RetryProvider) LoadBalancerInstances(id string) (instanceIDs []int, err error) {
+	err = p.policy.Do(fmt.Sprintf("Listing instances behind load balancer %s", id), func() error {
+		instanceIDs, err = p.provider.LoadBalancerInstances(id)
+		return err
+	})
+	return instanceIDs, err
+}
+
+func (p *RetryProvider) AddToLoadBalancer(id string, instanceIDs ...int) error {
+	return p.policy.Do(fmt.Sprintf("Adding instances %v to load balancer %s", instanceIDs, id), func() error {
+		return p.provider.AddToLoadBalancer(id, instanceIDs...)
+	})
+}
+
+func (p *RetryProvider) RemoveFromLoadBalancer(id string, instanceIDs ...int) error {
+	return p.policy.Do(fmt.Sprintf("Removing instances %v from load balancer %s", instanceIDs, id), func() error {
+		return p.provider.RemoveFromLoadBalancer(id, instanceIDs...)
+	})
+}
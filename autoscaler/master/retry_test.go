@@ -0,0 +1,143 @@
+package master
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Provider whose creates fail a number of times, optionally after launching the instance anyway
+type flakyProvider struct {
+	*fakeProvider
+	failures int
+	// Whether failed creates still launch the instance, as a timed out request might
+	launchAnyway bool
+	// Returned by listings, if set
+	listErr error
+}
+
+func (p *flakyProvider) CreateInstance(request *InstanceRequest) (*Instance, error) {
+	if p.failures == 0 {
+		return p.fakeProvider.CreateInstance(request)
+	}
+
+	p.failures--
+	if p.launchAnyway {
+		p.fakeProvider.CreateInstance(request)
+	}
+	return nil, fmt.Errorf("503 service unavailable")
+}
+
+func (p *flakyProvider) ListInstancesByTag(tag string) ([]Instance, error) {
+	if p.listErr != nil {
+		return nil, p.listErr
+	}
+	return p.fakeProvider.ListInstancesByTag(tag)
+}
+
+func TestRetryCreateInstance(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		launchAnyway bool
+		listErr      error
+		wantErr      bool
+		wantCreated  int
+	}{
+		{name: "succeeds first time", wantCreated: 1},
+		{name: "retries a failed create", failures: 2, wantCreated: 1},
+		{name: "adopts an instance launched by a failed create", failures: 1, launchAnyway: true, wantCreated: 1},
+		{name: "gives up after the attempts", failures: 3, wantErr: true},
+		{name: "stops if it can't check for a launched instance", failures: 1, listErr: fmt.Errorf("timeout"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &flakyProvider{newFakeProvider(), test.failures, test.launchAnyway, test.listErr}
+			retry := NewRetryProvider(provider, RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+			instance, err := retry.CreateInstance(&InstanceRequest{Name: "web-1", Tags: []string{"web"}})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if err == nil && instance.Name != "web-1" {
+				t.Errorf("created %+v", instance)
+			}
+
+			instances, _ := provider.fakeProvider.ListInstances()
+			if len(instances) != test.wantCreated {
+				t.Errorf("%d instances launched, want %d", len(instances), test.wantCreated)
+			}
+		})
+	}
+}
+
+// Provider whose deletes time out a number of times after deleting the instance anyway
+type slowDeleteProvider struct {
+	*fakeProvider
+	timeouts int
+}
+
+func (p *slowDeleteProvider) DeleteInstance(id int) error {
+	if _, err := p.GetInstance(id); err != nil {
+		return err
+	}
+	p.fakeProvider.DeleteInstance(id)
+	if p.timeouts > 0 {
+		p.timeouts--
+		return fmt.Errorf("timeout awaiting response headers")
+	}
+	return nil
+}
+
+func TestRetryDeleteInstance(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts int
+		missing  bool
+		wantErr  bool
+	}{
+		{name: "succeeds first time"},
+		{name: "missing after a timed out delete", timeouts: 1},
+		{name: "missing from the start", missing: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &slowDeleteProvider{newFakeProvider(), test.timeouts}
+			id := provider.add("web-1", InstanceActive, time.Hour).ID
+			if test.missing {
+				provider.fakeProvider.DeleteInstance(id)
+			}
+			retry := NewRetryProvider(provider, RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+			if err := retry.DeleteInstance(id); (err != nil) != test.wantErr {
+				t.Errorf("error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	calls := 0
+	err := policy.Do("Permanent failure", func() error {
+		calls++
+		return &PermanentError{fmt.Errorf("422 unprocessable")}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("permanent error: %v after %d calls, want one call", err, calls)
+	}
+
+	calls = 0
+	err = policy.Do("Temporary failure", func() error {
+		if calls++; calls < 3 {
+			return fmt.Errorf("500 internal error")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("temporary errors: %v after %d calls, want success on the third", err, calls)
+	}
+}
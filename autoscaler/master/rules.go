@@ -0,0 +1,186 @@
+package master
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Condition over one metric aggregated across the workers, e.g. "p90 of cpu_percent > 75 in 3 of
+// the last 5 surveys"
+type MetricRule struct {
+	Metric string `json:"metric"`
+	// "mean" (the default), "min", "max", "sum", or a percentile such as "p90"
+	Aggregation string `json:"aggregation"`
+	// One of ">", ">=", "<" or "<="
+	Comparison string  `json:"comparison"`
+	Threshold  float64 `json:"threshold"`
+	// Number of the last Periods surveys the condition has to hold in. Datapoints defaults to 1 and
+	// Periods to Datapoints, i.e. consecutive surveys
+	Datapoints int `json:"datapoints"`
+	Periods    int `json:"periods"`
+}
+
+func (r *MetricRule) String() string {
+	aggregation := r.Aggregation
+	if aggregation == "" {
+		aggregation = "mean"
+	}
+	return fmt.Sprintf("%s of %s %s %g", aggregation, r.Metric, r.Comparison, r.Threshold)
+}
+
+func (r *MetricRule) validate() error {
+	if r.Metric == "" {
+		return fmt.Errorf("rule is missing a metric")
+	}
+	if _, err := aggregate(r.Aggregation, []float64{0}); err != nil {
+		return err
+	}
+	switch r.Comparison {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("rule '%s' has unknown comparison '%s'", r, r.Comparison)
+	}
+	if r.Periods > 0 && r.Datapoints > r.Periods {
+		return fmt.Errorf("rule '%s' needs more datapoints than periods", r)
+	}
+	return nil
+}
+
+func (r *MetricRule) window() EvaluationWindow {
+	return EvaluationWindow{r.Datapoints, r.Periods}.withDefaults()
+}
+
+// Whether the condition holds for a snapshot. Returns false if no worker reported the metric
+func (r *MetricRule) breached(metrics MetricsSnapshot) bool {
+	value, ok := metrics.aggregate(r.Metric, r.Aggregation)
+	if !ok {
+		return false
+	}
+
+	switch r.Comparison {
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	}
+	return false
+}
+
+// Whether the condition held in enough of the most recent snapshots
+func (r *MetricRule) sustained(history *MetricHistory) bool {
+	window := r.window()
+
+	breaches := 0
+	for _, snapshot := range history.Latest(window.Periods) {
+		if r.breached(snapshot) {
+			breaches++
+		}
+	}
+	return breaches >= window.Datapoints
+}
+
+// Aggregate a metric across every worker that reported it
+func (s *MetricsSnapshot) aggregate(metric, aggregation string) (float64, bool) {
+	var values []float64
+	for _, workerMetrics := range s.WorkerMetrics {
+		if value, ok := workerMetrics[metric]; ok {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return 0, false
+	}
+
+	value, err := aggregate(aggregation, values)
+	return value, err == nil
+}
+
+func aggregate(aggregation string, values []float64) (float64, error) {
+	switch aggregation {
+	case "", "mean":
+		sum, _ := aggregate("sum", values)
+		return sum / float64(len(values)), nil
+	case "sum":
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum, nil
+	case "min":
+		return percentile(values, 0), nil
+	case "max":
+		return percentile(values, 100), nil
+	}
+
+	var p float64
+	if _, err := fmt.Sscanf(aggregation, "p%g", &p); err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("unknown aggregation '%s'", aggregation)
+	}
+	return percentile(values, p), nil
+}
+
+// Nearest-rank percentile
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// Adds workers when any scale-out rule holds, and removes workers when every scale-in rule holds.
+// Rules are evaluated against the recorded metric history
+type RulesPolicy struct {
+	scaleOut, scaleIn                     []MetricRule
+	scaleOutAdjustment, scaleInAdjustment int64
+	history                               *MetricHistory
+}
+
+func NewRulesPolicy(scaleOut, scaleIn []MetricRule, scaleOutAdjustment, scaleInAdjustment int64, history *MetricHistory) (*RulesPolicy, error) {
+	if len(scaleOut) == 0 && len(scaleIn) == 0 {
+		return nil, fmt.Errorf("rules policy needs scaleOutRules or scaleInRules")
+	}
+	if scaleOutAdjustment <= 0 {
+		scaleOutAdjustment = 1
+	}
+	if scaleInAdjustment <= 0 {
+		scaleInAdjustment = 1
+	}
+
+	for _, rules := range [][]MetricRule{scaleOut, scaleIn} {
+		for _, rule := range rules {
+			if err := rule.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &RulesPolicy{scaleOut, scaleIn, scaleOutAdjustment, scaleInAdjustment, history}, nil
+}
+
+func (p *RulesPolicy) DesiredCapacity(metrics MetricsSnapshot, fleet FleetState) int64 {
+	for _, rule := range p.scaleOut {
+		if rule.sustained(p.history) {
+			fmt.Printf("Scale-out rule met: %s\n", &rule)
+			return fleet.Current + p.scaleOutAdjustment
+		}
+	}
+
+	if len(p.scaleIn) == 0 {
+		return fleet.Current
+	}
+	for _, rule := range p.scaleIn {
+		if !rule.sustained(p.history) {
+			return fleet.Current
+		}
+	}
+	fmt.Println("All scale-in rules met")
+	return fleet.Current - p.scaleInAdjustment
+}
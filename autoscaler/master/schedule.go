@@ -0,0 +1,100 @@
+package master
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultScheduleDuration = 3600
+
+// Scheduled change to the pool's capacity, e.g. raising the minimum every weekday morning
+type ScheduledAction struct {
+	Name string `json:"name"`
+	// Five-field cron expression for when the action starts
+	Cron string `json:"cron"`
+	// How long (in seconds) the action lasts each time it starts. Defaults to an hour
+	Duration int64 `json:"duration"`
+	// IANA time zone the cron expression is in. Defaults to UTC
+	Timezone string `json:"timezone"`
+	// Capacity while the action is in effect. Unset fields leave the configured value alone.
+	// Desired is a floor: the policy can still scale above it
+	Min     *int64 `json:"min"`
+	Max     *int64 `json:"max"`
+	Desired *int64 `json:"desired"`
+}
+
+type scheduledAction struct {
+	ScheduledAction
+	cron     *cronSchedule
+	location *time.Location
+	active   bool
+}
+
+// Capacity overrides from the scheduled actions currently in effect
+type Schedule struct {
+	actions []*scheduledAction
+}
+
+func NewSchedule(configs []ScheduledAction) (*Schedule, error) {
+	schedule := &Schedule{}
+	for i, config := range configs {
+		action := &scheduledAction{ScheduledAction: config}
+		if action.Name == "" {
+			action.Name = fmt.Sprintf("schedule-%d", i+1)
+		}
+		if action.Duration <= 0 {
+			action.Duration = defaultScheduleDuration
+		}
+
+		var err error
+		if action.cron, err = parseCron(action.Cron); err != nil {
+			return nil, fmt.Errorf("scheduled action '%s': %s", action.Name, err)
+		}
+		if action.location, err = time.LoadLocation(action.Timezone); err != nil {
+			return nil, fmt.Errorf("scheduled action '%s': %s", action.Name, err)
+		}
+		if action.Min == nil && action.Max == nil && action.Desired == nil {
+			return nil, fmt.Errorf("scheduled action '%s' needs min, max or desired", action.Name)
+		}
+		if action.Min != nil && action.Max != nil && *action.Min > *action.Max {
+			return nil, fmt.Errorf("scheduled action '%s' has min above max", action.Name)
+		}
+		schedule.actions = append(schedule.actions, action)
+	}
+	return schedule, nil
+}
+
+// Apply the actions in effect at the given time to the configured limits. Later actions take
+// precedence over earlier ones. desired is nil unless an action sets it
+func (s *Schedule) Apply(now time.Time, min, max int64) (int64, int64, *int64) {
+	var desired *int64
+	for _, action := range s.actions {
+		_, active := action.cron.lastFired(now.In(action.location), time.Duration(action.Duration)*time.Second)
+		if active != action.active {
+			if active {
+				fmt.Printf("Scheduled action %s started\n", action.Name)
+			} else {
+				fmt.Printf("Scheduled action %s ended\n", action.Name)
+			}
+			action.active = active
+		}
+		if !active {
+			continue
+		}
+
+		if action.Min != nil {
+			min = *action.Min
+		}
+		if action.Max != nil {
+			max = *action.Max
+		}
+		if action.Desired != nil {
+			desired = action.Desired
+		}
+	}
+
+	if min > max {
+		max = min
+	}
+	return min, max, desired
+}
@@ -0,0 +1,226 @@
+package master
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/jstol/digital-ocean-autoscaler/protocol"
+
+	"github.com/gdamore/mangos"
+	"github.com/gdamore/mangos/protocol/surveyor"
+	"github.com/gdamore/mangos/transport/tcp"
+)
+
+// Surveyor owns the survey socket shared by every pool. It surveys all of the workers at once and
+// hands each pool's master the responses from its own workers
+type Surveyor struct {
+	url                           url.URL
+	surveyDeadline, queryInterval time.Duration
+	masters                       []*Master
+	pools                         map[string]*Master
+}
+
+func NewSurveyor(host string, surveyDeadline, queryInterval time.Duration, masters ...*Master) (*Surveyor, error) {
+	pools := make(map[string]*Master)
+	for _, m := range masters {
+		if _, ok := pools[m.name]; ok {
+			return nil, fmt.Errorf("more than one pool is named '%s'", m.name)
+		}
+		pools[m.name] = m
+	}
+
+	return &Surveyor{
+		url:            url.URL{Scheme: "tcp", Host: host},
+		surveyDeadline: surveyDeadline,
+		queryInterval:  queryInterval,
+		masters:        masters,
+		pools:          pools,
+	}, nil
+}
+
+// Start every pool's master and survey the workers indefinitely
+func (s *Surveyor) Run() error {
+	sock, err := s.openSocket()
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	for _, m := range s.masters {
+		go m.monitor()
+	}
+
+	for {
+		s.survey(sock)
+		time.Sleep(s.queryInterval)
+	}
+}
+
+func (s *Surveyor) openSocket() (mangos.Socket, error) {
+	var (
+		err  error
+		sock mangos.Socket
+	)
+
+	// Try to get new "surveyor" socket
+	if sock, err = surveyor.NewSocket(); err != nil {
+		return nil, fmt.Errorf("can't get new surveyor socket: %s", err)
+	}
+
+	sock.AddTransport(tcp.NewTransport())
+
+	// Begin listening on the URL
+	if err = sock.Listen(s.url.String()); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("can't listen on surveyor socket: %s", err)
+	}
+
+	// Set "deadline" for the survey and a timeout for receiving responses
+	if err = sock.SetOption(mangos.OptionSurveyTime, s.surveyDeadline); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("SetOption(mangos.OptionSurveyTime): %s", err)
+	}
+	if err = sock.SetOption(mangos.OptionRecvDeadline, s.surveyDeadline+(1*time.Second)); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("SetOption(mangos.OptionRecvDeadline): %s", err)
+	}
+
+	return sock, nil
+}
+
+// Send one survey, collect the responses and pass them on to the pools they belong to
+func (s *Surveyor) survey(sock mangos.Socket) {
+	survey, err := protocol.EncodeSurvey(protocol.NewSurvey())
+	if err != nil {
+		fmt.Printf("Failed encoding survey: %s\n", err.Error())
+		return
+	}
+
+	fmt.Println("Sending master request")
+	if err = sock.Send(survey); err != nil {
+		fmt.Printf("Failed sending survey: %s\n", err.Error())
+		return
+	}
+
+	reports := make(map[*Master][]*protocol.Report)
+	for {
+		var msg []byte
+		if msg, err = sock.Recv(); err != nil {
+			break
+		}
+
+		var report *protocol.Report
+		if report, err = protocol.DecodeReport(msg); err != nil {
+			fmt.Printf("Invalid survey response: %s. Skipping...\n", err.Error())
+			continue
+		}
+
+		if m := s.route(report); m != nil {
+			reports[m] = append(reports[m], report)
+		}
+	}
+
+	// Every pool hears back after each survey, even if none of its workers answered
+	for _, m := range s.masters {
+		select {
+		case m.reports <- reports[m]:
+		default:
+			fmt.Printf("Pool %s is still handling the last survey. Skipping...\n", m.name)
+		}
+	}
+}
+
+// Find the pool a response belongs to: the one the worker announced, or for workers that don't
+// announce one, the pool that knows the worker
+func (s *Surveyor) route(report *protocol.Report) *Master {
+	if report.Pool != "" {
+		m, ok := s.pools[report.Pool]
+		if !ok {
+			fmt.Printf("Message received from worker '%s' in unknown pool '%s'. Skipping...\n", report.Addr, report.Pool)
+		}
+		return m
+	}
+
+	for _, m := range s.masters {
+		if m.knows(report) {
+			return m
+		}
+	}
+
+	// With one pool, let it report the unknown worker as before
+	if len(s.masters) == 1 {
+		return s.masters[0]
+	}
+	fmt.Printf("Message received from unknown worker '%s' (droplet %d). Skipping...\n", report.Addr, report.DropletID)
+	return nil
+}
+
+// Whether a survey response came from one of the pool's workers
+func (m *Master) knows(report *protocol.Report) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.reportingWorker(report) != nil
+}
+
+// Turn each survey's responses from the pool's workers into a metrics snapshot
+func (m *Master) handleReports(c chan<- MetricsSnapshot) {
+	for reports := range m.reports {
+		loadAvgs := make(map[string]float64)
+		workerMetrics := make(map[string]map[string]float64)
+		for _, report := range reports {
+			// Find the corresponding droplet and record its metrics
+			m.lock.Lock()
+			worker := m.reportingWorker(report)
+			if worker != nil {
+				worker.metrics = report.Metrics
+				worker.protocolVersion = report.Version
+				if loadAvg, ok := report.Metrics[protocol.MetricLoadAvg]; ok {
+					worker.loadAvg = loadAvg
+				}
+			}
+			m.lock.Unlock()
+
+			if worker == nil {
+				fmt.Printf("Message received from unknown worker '%s' (droplet %d). Skipping...\n", report.Addr, report.DropletID)
+				continue
+			}
+
+			workerMetrics[worker.instance.Name] = report.Metrics
+			if loadAvg, ok := report.Metrics[protocol.MetricLoadAvg]; ok {
+				loadAvgs[worker.instance.Name] = loadAvg
+			}
+		}
+
+		// Add what the load balancer knows about each worker
+		m.addLoadBalancerMetrics(workerMetrics)
+
+		// Compute the average loadAvg
+		var loadAvg float64
+		for _, avg := range loadAvgs {
+			loadAvg += avg
+		}
+		loadAvg /= float64(len(loadAvgs))
+
+		// Send the load averages
+		if !math.IsNaN(loadAvg) {
+			c <- MetricsSnapshot{time.Now(), loadAvg, loadAvgs, workerMetrics}
+		}
+	}
+}
+
+// Find the worker a survey response came from, by droplet ID if the worker knows it and by
+// private address otherwise. Must be called with the lock held
+func (m *Master) reportingWorker(report *protocol.Report) *Worker {
+	if report.DropletID != 0 {
+		return m.findWorker(report.DropletID)
+	}
+	for _, worker := range m.workers {
+		if worker.privateAddr == report.Addr {
+			return worker
+		}
+	}
+	return nil
+}
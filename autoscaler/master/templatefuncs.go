@@ -0,0 +1,102 @@
+package master
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Helper functions available in load balancer config templates. They follow sprig's names and
+// argument order, with the value being worked on last so they can be used in pipelines, e.g.
+// {{ .Fleet.Generated | date "2006-01-02" }}
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// Strings
+		"lower":   strings.ToLower,
+		"upper":   strings.ToUpper,
+		"replace": func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"quote":   func(v interface{}) string { return fmt.Sprintf("%q", fmt.Sprint(v)) },
+		"default": templateDefault,
+
+		// Lists
+		"has":       templateHas,
+		"join":      templateJoin,
+		"sortAlpha": templateSortAlpha,
+
+		"date": func(layout string, t time.Time) string { return t.Format(layout) },
+	}
+}
+
+// The items of a list as strings
+func templateStrings(name string, list interface{}) ([]string, error) {
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%s: expected a list, got %T", name, list)
+	}
+
+	items := make([]string, value.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(value.Index(i).Interface())
+	}
+	return items, nil
+}
+
+// A list's items joined into a string, e.g. {{ .Tags | join "," }}
+func templateJoin(sep string, list interface{}) (string, error) {
+	items, err := templateStrings("join", list)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(items, sep), nil
+}
+
+// A list's items as strings in alphabetical order, e.g. {{ range sortAlpha .Tags }}
+func templateSortAlpha(list interface{}) ([]string, error) {
+	items, err := templateStrings("sortAlpha", list)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(items)
+	return items, nil
+}
+
+// The value, or the default if the value is nil, zero or empty, e.g. {{ .Fleet.Tag | default "web" }}
+func templateDefault(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || value[0] == nil {
+		return def
+	}
+
+	v := reflect.ValueOf(value[0])
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		if v.Len() == 0 {
+			return def
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return def
+		}
+	default:
+		if reflect.DeepEqual(value[0], reflect.Zero(v.Type()).Interface()) {
+			return def
+		}
+	}
+	return value[0]
+}
+
+// Whether a list contains a value, e.g. {{ if has "backup" .Tags }}
+func templateHas(needle, list interface{}) (bool, error) {
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return false, fmt.Errorf("has: expected a list, got %T", list)
+	}
+	for i := 0; i < value.Len(); i++ {
+		if reflect.DeepEqual(value.Index(i).Interface(), needle) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,109 @@
+package master
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	generated := time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{`{{ if has "backup" .Tags }}yes{{ else }}no{{ end }}`, "yes"},
+		{`{{ if has "canary" .Tags }}yes{{ else }}no{{ end }}`, "no"},
+		{`{{ if has "backup" .Empty }}yes{{ else }}no{{ end }}`, "no"},
+		{`{{ .Generated | date "2006-01-02 15:04" }}`, "2017-03-04 05:06"},
+		{`{{ .Tags | join "," }}`, "web,backup"},
+		{`{{ .Ports | join " " }}`, "80 443"},
+		{`{{ range sortAlpha .Tags }}{{ . }};{{ end }}`, "backup;web;"},
+		{`{{ .Name | upper }} {{ "WEB" | lower }}`, "WEB-1 web"},
+		{`{{ .Name | replace "-" "_" }}`, "web_1"},
+		{`{{ .Name | quote }}`, `"web-1"`},
+		{`{{ .Empty | default "none" }} {{ .Name | default "none" }}`, "none web-1"},
+		{`{{ .Zero | default 80 }} {{ "" | default "x" }}`, "80 x"},
+	}
+
+	data := struct {
+		Name      string
+		Tags      []string
+		Empty     []string
+		Ports     []int
+		Zero      int
+		Generated time.Time
+	}{"web-1", []string{"web", "backup"}, nil, []int{80, 443}, 0, generated}
+	for _, test := range tests {
+		temp, err := template.New("test").Funcs(templateFuncs()).Parse(test.template)
+		if err != nil {
+			t.Fatalf("%s: %s", test.template, err)
+		}
+		var buffer bytes.Buffer
+		if err = temp.Execute(&buffer, data); err != nil {
+			t.Fatalf("%s: %s", test.template, err)
+		}
+		if buffer.String() != test.want {
+			t.Errorf("%s rendered %q, want %q", test.template, buffer.String(), test.want)
+		}
+	}
+
+	if _, err := templateHas("web", "web"); err == nil {
+		t.Error("has accepted a string as a list")
+	}
+	if _, err := templateJoin(",", "web"); err == nil {
+		t.Error("join accepted a string as a list")
+	}
+}
+
+// The templates shipped in autoscaler/ render with every helper they use
+func TestShippedTemplates(t *testing.T) {
+	data := TemplateData{
+		Servers: []BackendServer{
+			{Name: "web-1", Addr: "10.0.0.1", Weight: 10},
+			{Name: "web-2", Addr: "10.0.0.2", Weight: 20, Tags: []string{"backup"}},
+			{Name: "web-3", Addr: "10.0.0.3", Weight: 10, Draining: true},
+		},
+		Fleet: FleetInfo{Pool: "web", Backend: "web", Port: 8080, ListenPort: 8000, Workers: 3, Draining: 1, Generated: time.Now()},
+	}
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{"haproxy-template.cfg", []string{
+			"bind *:8000\n",
+			"default_backend web\n",
+			"backend web\n",
+			"server web-1 10.0.0.1:8080 weight 10 check\n",
+			"server web-2 10.0.0.2:8080 weight 20 check backup\n",
+			"server web-3 10.0.0.3:8080 weight 10 check disabled\n",
+		}},
+		{"nginx-template.conf", []string{
+			"upstream web {",
+			"server 10.0.0.1:8080 weight=10; # web-1",
+			"listen 8000;",
+			"proxy_pass http://web;",
+		}},
+		{"example-template.txt", []string{"bind *:8000\n", "backend web\n", "server web-1 10.0.0.1:8080 weight 10 check"}},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join("..", test.template)
+		temp, err := template.New(filepath.Base(path)).Funcs(templateFuncs()).ParseFiles(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buffer bytes.Buffer
+		if err = temp.Execute(&buffer, data); err != nil {
+			t.Fatalf("%s: %s", test.template, err)
+		}
+		for _, want := range test.want {
+			if !strings.Contains(buffer.String(), want) {
+				t.Errorf("%s is missing %q:\n%s", test.template, want, buffer.String())
+			}
+		}
+	}
+}
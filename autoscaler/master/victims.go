@@ -0,0 +1,126 @@
+package master
+
+import (
+	"fmt"
+	"time"
+)
+
+// Strategy for choosing which worker to remove when scaling in
+type VictimSelector interface {
+	// Pick the worker to remove, or nil if none of the candidates should be removed
+	SelectVictim(candidates []*Worker) *Worker
+}
+
+// Removes the worker with the lowest reported load average
+type LeastLoadedSelector struct{}
+
+func (s *LeastLoadedSelector) SelectVictim(candidates []*Worker) *Worker {
+	var victim *Worker
+	for _, worker := range candidates {
+		if victim == nil || worker.loadAvg < victim.loadAvg {
+			victim = worker
+		}
+	}
+	return victim
+}
+
+// Removes the most recently created worker
+type NewestFirstSelector struct{}
+
+func (s *NewestFirstSelector) SelectVictim(candidates []*Worker) *Worker {
+	var victim *Worker
+	for _, worker := range candidates {
+		if victim == nil || !worker.created().Before(victim.created()) {
+			victim = worker
+		}
+	}
+	return victim
+}
+
+// Removes the longest running worker
+type OldestFirstSelector struct{}
+
+func (s *OldestFirstSelector) SelectVictim(candidates []*Worker) *Worker {
+	var victim *Worker
+	for _, worker := range candidates {
+		if victim == nil || worker.created().Before(victim.created()) {
+			victim = worker
+		}
+	}
+	return victim
+}
+
+// Removes the worker with the fewest open sessions according to the load balancer. Falls back to
+// another selector if the session counts can't be fetched
+type LeastConnectionsSelector struct {
+	sessions func() (map[string]int64, error)
+	fallback VictimSelector
+}
+
+func (s *LeastConnectionsSelector) SelectVictim(candidates []*Worker) *Worker {
+	sessions, err := s.sessions()
+	if err != nil {
+		fmt.Printf("Error getting session counts, falling back: %s\n", err.Error())
+		return s.fallback.SelectVictim(candidates)
+	}
+
+	var victim *Worker
+	for _, worker := range candidates {
+		if victim == nil || sessions[worker.instance.Name] < sessions[victim.instance.Name] {
+			victim = worker
+		}
+	}
+	return victim
+}
+
+// Wraps another selector, never choosing the droplets listed in the worker config
+type ProtectBaselineSelector struct {
+	selector VictimSelector
+	baseline map[string]bool
+}
+
+func (s *ProtectBaselineSelector) SelectVictim(candidates []*Worker) *Worker {
+	var unprotected []*Worker
+	for _, worker := range candidates {
+		if !s.baseline[worker.instance.Name] {
+			unprotected = append(unprotected, worker)
+		}
+	}
+	return s.selector.SelectVictim(unprotected)
+}
+
+// Build the victim selector described by the worker config
+// sessions returns the load balancer's current session count for each worker
+func newVictimSelector(config *WorkerConfig, sessions func() (map[string]int64, error)) (VictimSelector, error) {
+	var selector VictimSelector
+	switch config.VictimSelection {
+	case "", "newest":
+		selector = &NewestFirstSelector{}
+	case "oldest":
+		selector = &OldestFirstSelector{}
+	case "least-loaded":
+		selector = &LeastLoadedSelector{}
+	case "least-connections":
+		selector = &LeastConnectionsSelector{sessions, &LeastLoadedSelector{}}
+	default:
+		return nil, fmt.Errorf("unknown victim selection strategy '%s'", config.VictimSelection)
+	}
+
+	if config.ProtectBaseline {
+		baseline := make(map[string]bool)
+		for _, name := range config.DropletNames {
+			baseline[name] = true
+		}
+		selector = &ProtectBaselineSelector{selector, baseline}
+	}
+
+	return selector, nil
+}
+
+// When the worker's droplet was created, falling back to when the master first saw it
+func (w *Worker) created() time.Time {
+	if w.instance.Created.IsZero() {
+		return w.joined
+	}
+	return w.instance.Created
+}
@@ -0,0 +1,70 @@
+package master
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVictimSelection(t *testing.T) {
+	sessions := map[string]int64{"web-a": 5, "web-b": 9, "web-c": 2}
+	failing := func() (map[string]int64, error) { return nil, fmt.Errorf("stats socket unavailable") }
+
+	tests := []struct {
+		name     string
+		config   WorkerConfig
+		sessions func() (map[string]int64, error)
+		want     string
+	}{
+		{name: "newest by default", want: "web-c"},
+		{name: "newest", config: WorkerConfig{VictimSelection: "newest"}, want: "web-c"},
+		{name: "oldest", config: WorkerConfig{VictimSelection: "oldest"}, want: "web-a"},
+		{name: "least loaded", config: WorkerConfig{VictimSelection: "least-loaded"}, want: "web-b"},
+		{name: "least connections", config: WorkerConfig{VictimSelection: "least-connections"}, want: "web-c"},
+		{
+			name: "least connections without stats falls back to least loaded", config: WorkerConfig{VictimSelection: "least-connections"},
+			sessions: failing, want: "web-b",
+		},
+		{
+			name: "baseline is protected", config: WorkerConfig{VictimSelection: "oldest", ProtectBaseline: true, DropletNames: []string{"web-a"}},
+			want: "web-b",
+		},
+		{
+			name: "only baseline left", config: WorkerConfig{ProtectBaseline: true, DropletNames: []string{"web-a", "web-b", "web-c"}},
+			want: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider()
+			var workers []*Worker
+			for i, name := range []string{"web-a", "web-b", "web-c"} {
+				worker := newWorker(provider.add(name, InstanceActive, time.Duration(3-i)*time.Hour), provider)
+				worker.loadAvg = []float64{0.5, 0.1, 0.9}[i]
+				workers = append(workers, worker)
+			}
+
+			if test.sessions == nil {
+				test.sessions = func() (map[string]int64, error) { return sessions, nil }
+			}
+			selector, err := newVictimSelector(&test.config, test.sessions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			victim := selector.SelectVictim(workers)
+			got := ""
+			if victim != nil {
+				got = victim.instance.Name
+			}
+			if got != test.want {
+				t.Errorf("picked %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	if _, err := newVictimSelector(&WorkerConfig{VictimSelection: "random"}, nil); err == nil {
+		t.Error("no error for an unknown strategy")
+	}
+}
@@ -0,0 +1,193 @@
+package master
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jstol/digital-ocean-autoscaler/protocol"
+)
+
+const (
+	// Range of weights HAProxy accepts, kept above 0 so no worker is taken out of rotation
+	minWeight = 1
+	maxWeight = 256
+
+	defaultWeightInterval = 20 * time.Second
+)
+
+// What a weight strategy knows about one worker
+type WeightInput struct {
+	Name    string
+	LoadAvg float64
+	Metrics map[string]float64
+	// Latest stats from the load balancer, or nil
+	Stats *ServerStats
+}
+
+// WeightStrategy works out the load balancer weight of each worker, keyed by name
+type WeightStrategy interface {
+	Weights(workers []WeightInput) map[string]int64
+}
+
+// Round a weight to the nearest whole number in range
+func clampWeight(weight float64) int64 {
+	return int64(math.Max(minWeight, math.Min(maxWeight, math.Floor(weight+0.5))))
+}
+
+// Weights falling linearly from 256 for an idle worker to 1 for one at the overloaded threshold.
+// Workers with requests queued at the load balancer are treated as saturated
+type LinearInverseLoadStrategy struct {
+	MaxLoad float64
+}
+
+func (s *LinearInverseLoadStrategy) Weights(workers []WeightInput) map[string]int64 {
+	weights := make(map[string]int64)
+	for _, worker := range workers {
+		avg := worker.LoadAvg
+		maxLoad := s.MaxLoad
+		// Requests queueing at the load balancer mean the worker is saturated, whatever its load
+		if worker.Stats != nil && worker.Stats.Queue > 0 {
+			avg = maxLoad
+		}
+		if avg < 0.001 {
+			avg = 0.001
+		}
+		if avg > maxLoad {
+			avg = maxLoad
+		}
+
+		// Calculate the worker's weight
+		weights[worker.Name] = int64(((255 / maxLoad) * ((maxLoad + 0.001) - avg)) + 1)
+	}
+	return weights
+}
+
+// Weights proportional to each worker's core count, for pools with mixed droplet sizes. The
+// biggest worker gets 256. Workers that haven't reported their cores count as one
+type CoreCountStrategy struct{}
+
+func (s *CoreCountStrategy) Weights(workers []WeightInput) map[string]int64 {
+	cores := make(map[string]float64)
+	most := 1.0
+	for _, worker := range workers {
+		count := worker.Metrics[protocol.MetricCores]
+		if count < 1 {
+			count = 1
+		}
+		cores[worker.Name] = count
+		most = math.Max(most, count)
+	}
+
+	weights := make(map[string]int64)
+	for name, count := range cores {
+		weights[name] = clampWeight(maxWeight * count / most)
+	}
+	return weights
+}
+
+// Weights inversely proportional to each worker's average response time at the load balancer,
+// relative to the fastest worker, which gets 256. Falls back to another strategy when no
+// response times are known
+type LatencyAwareStrategy struct {
+	fallback WeightStrategy
+}
+
+func (s *LatencyAwareStrategy) Weights(workers []WeightInput) map[string]int64 {
+	fastest := math.Inf(1)
+	for _, worker := range workers {
+		if worker.Stats != nil && worker.Stats.ResponseTime > 0 {
+			fastest = math.Min(fastest, worker.Stats.ResponseTime)
+		}
+	}
+	if math.IsInf(fastest, 1) {
+		return s.fallback.Weights(workers)
+	}
+
+	weights := make(map[string]int64)
+	for _, worker := range workers {
+		// Workers that haven't served anything recently are given the benefit of the doubt
+		responseTime := fastest
+		if worker.Stats != nil && worker.Stats.ResponseTime > 0 {
+			responseTime = worker.Stats.ResponseTime
+		}
+		weights[worker.Name] = clampWeight(maxWeight * fastest / responseTime)
+	}
+	return weights
+}
+
+// Wraps another strategy, moving each worker's weight only part of the way to its new value
+// (an EWMA) and by at most a maximum step per update, so load doesn't swing between workers
+type SmoothedStrategy struct {
+	strategy WeightStrategy
+	// Weight given to the new value, between 0 and 1
+	alpha   float64
+	maxStep float64
+	current map[string]float64
+}
+
+func NewSmoothedStrategy(strategy WeightStrategy, alpha float64, maxStep int64) *SmoothedStrategy {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 1
+	}
+	step := math.Inf(1)
+	if maxStep > 0 {
+		step = float64(maxStep)
+	}
+	return &SmoothedStrategy{strategy, alpha, step, make(map[string]float64)}
+}
+
+func (s *SmoothedStrategy) Weights(workers []WeightInput) map[string]int64 {
+	targets := s.strategy.Weights(workers)
+
+	smoothed := make(map[string]float64)
+	weights := make(map[string]int64)
+	for name, target := range targets {
+		weight, ok := s.current[name]
+		if !ok {
+			// New workers start at their target
+			weight = float64(target)
+		} else {
+			change := s.alpha * (float64(target) - weight)
+			weight += math.Max(-s.maxStep, math.Min(s.maxStep, change))
+		}
+		smoothed[name] = weight
+		weights[name] = clampWeight(weight)
+	}
+
+	// Forget workers that are gone
+	s.current = smoothed
+	return weights
+}
+
+// Weight calculation section of the worker config
+type WeightConfig struct {
+	// "linear-inverse-load" (the default), "core-count" or "latency-aware"
+	Strategy string `json:"strategy"`
+	// Weight given to each new value when smoothing, between 0 and 1. 0 turns smoothing off
+	Smoothing float64 `json:"smoothing"`
+	// Most a weight can change in one update. 0 means no limit
+	MaxStep int64 `json:"maxStep"`
+	// How often (in seconds) to update the weights. Defaults to 20
+	Interval int64 `json:"interval"`
+}
+
+// Build the weight strategy described by the worker config
+func newWeightStrategy(config *WeightConfig, overloaded float64) (WeightStrategy, error) {
+	var strategy WeightStrategy
+	switch config.Strategy {
+	case "", "linear-inverse-load":
+		strategy = &LinearInverseLoadStrategy{overloaded}
+	case "core-count":
+		strategy = &CoreCountStrategy{}
+	case "latency-aware":
+		strategy = &LatencyAwareStrategy{&LinearInverseLoadStrategy{overloaded}}
+	default:
+		return nil, fmt.Errorf("unknown weight strategy '%s'", config.Strategy)
+	}
+
+	if config.Smoothing > 0 || config.MaxStep > 0 {
+		strategy = NewSmoothedStrategy(strategy, config.Smoothing, config.MaxStep)
+	}
+	return strategy, nil
+}
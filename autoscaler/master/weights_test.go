@@ -0,0 +1,131 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jstol/digital-ocean-autoscaler/protocol"
+)
+
+func TestWeightStrategies(t *testing.T) {
+	queued := &ServerStats{Queue: 3}
+	fast, slow := &ServerStats{ResponseTime: 20}, &ServerStats{ResponseTime: 80}
+
+	tests := []struct {
+		name     string
+		strategy WeightStrategy
+		workers  []WeightInput
+		want     map[string]int64
+	}{
+		{
+			name:     "linear inverse load",
+			strategy: &LinearInverseLoadStrategy{0.65},
+			workers:  []WeightInput{{Name: "idle"}, {Name: "half", LoadAvg: 0.325}, {Name: "overloaded", LoadAvg: 0.9}},
+			want:     map[string]int64{"idle": 256, "half": 128, "overloaded": 1},
+		},
+		{
+			name:     "linear inverse load treats a queue as saturated",
+			strategy: &LinearInverseLoadStrategy{0.65},
+			workers:  []WeightInput{{Name: "web-1", LoadAvg: 0.2, Stats: queued}, {Name: "web-2", LoadAvg: 0.2}},
+			want:     map[string]int64{"web-1": 1, "web-2": 177},
+		},
+		{
+			name:     "core count",
+			strategy: &CoreCountStrategy{},
+			workers: []WeightInput{
+				{Name: "big", Metrics: map[string]float64{protocol.MetricCores: 8}},
+				{Name: "small", Metrics: map[string]float64{protocol.MetricCores: 2}},
+				{Name: "unreported"},
+			},
+			want: map[string]int64{"big": 256, "small": 64, "unreported": 32},
+		},
+		{
+			name:     "latency aware",
+			strategy: &LatencyAwareStrategy{&LinearInverseLoadStrategy{0.65}},
+			workers:  []WeightInput{{Name: "fast", Stats: fast}, {Name: "slow", Stats: slow}, {Name: "quiet", LoadAvg: 0.6}},
+			want:     map[string]int64{"fast": 256, "slow": 64, "quiet": 256},
+		},
+		{
+			name:     "latency aware without response times",
+			strategy: &LatencyAwareStrategy{&LinearInverseLoadStrategy{0.65}},
+			workers:  []WeightInput{{Name: "idle"}, {Name: "overloaded", LoadAvg: 0.9}},
+			want:     map[string]int64{"idle": 256, "overloaded": 1},
+		},
+	}
+
+	for _, test := range tests {
+		if weights := test.strategy.Weights(test.workers); !reflect.DeepEqual(weights, test.want) {
+			t.Errorf("%s: weights %v, want %v", test.name, weights, test.want)
+		}
+	}
+}
+
+// Strategy giving each worker whatever weight it's been told to
+type fixedWeights map[string]int64
+
+func (f fixedWeights) Weights(workers []WeightInput) map[string]int64 {
+	weights := make(map[string]int64)
+	for _, worker := range workers {
+		weights[worker.Name] = f[worker.Name]
+	}
+	return weights
+}
+
+func TestSmoothedStrategy(t *testing.T) {
+	tests := []struct {
+		name    string
+		alpha   float64
+		maxStep int64
+		// Target weight at each update, and the weight given
+		targets, want []int64
+	}{
+		{name: "starts at the target", alpha: 0.5, targets: []int64{200}, want: []int64{200}},
+		{name: "moves part of the way", alpha: 0.5, targets: []int64{200, 100, 100, 100}, want: []int64{200, 150, 125, 113}},
+		{name: "alpha of 1 follows the target", alpha: 1, targets: []int64{200, 100}, want: []int64{200, 100}},
+		{name: "alpha out of range follows the target", alpha: 0, targets: []int64{200, 100}, want: []int64{200, 100}},
+		{name: "limited step", alpha: 1, maxStep: 30, targets: []int64{200, 100, 100}, want: []int64{200, 170, 140}},
+		{name: "limited step upwards", alpha: 0.5, maxStep: 20, targets: []int64{100, 200, 200}, want: []int64{100, 120, 140}},
+	}
+
+	for _, test := range tests {
+		target := fixedWeights{}
+		strategy := NewSmoothedStrategy(target, test.alpha, test.maxStep)
+		var got []int64
+		for _, weight := range test.targets {
+			target["web-1"] = weight
+			got = append(got, strategy.Weights([]WeightInput{{Name: "web-1"}})["web-1"])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: weights %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// A worker that comes back starts over at its target
+	target := fixedWeights{"web-1": 200}
+	strategy := NewSmoothedStrategy(target, 0.5, 0)
+	strategy.Weights([]WeightInput{{Name: "web-1"}})
+	strategy.Weights(nil)
+	target["web-1"] = 100
+	if weight := strategy.Weights([]WeightInput{{Name: "web-1"}})["web-1"]; weight != 100 {
+		t.Errorf("returning worker given %d, want 100", weight)
+	}
+}
+
+func TestNewWeightStrategy(t *testing.T) {
+	strategy, err := newWeightStrategy(&WeightConfig{Strategy: "core-count", Smoothing: 0.5}, 0.65)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if smoothed, ok := strategy.(*SmoothedStrategy); !ok {
+		t.Errorf("smoothing gave %T, want a SmoothedStrategy", strategy)
+	} else if _, ok := smoothed.strategy.(*CoreCountStrategy); !ok {
+		t.Errorf("smoothing %T, want a CoreCountStrategy", smoothed.strategy)
+	}
+
+	if strategy, _ = newWeightStrategy(&WeightConfig{}, 0.65); reflect.TypeOf(strategy) != reflect.TypeOf(&LinearInverseLoadStrategy{}) {
+		t.Errorf("default strategy %T, want a LinearInverseLoadStrategy", strategy)
+	}
+	if _, err = newWeightStrategy(&WeightConfig{Strategy: "random"}, 0.65); err == nil {
+		t.Error("no error for an unknown strategy")
+	}
+}
@@ -3,16 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jstol/digital-ocean-autoscaler/protocol"
 	"github.com/jstol/digital-ocean-autoscaler/utils"
 
 	"github.com/gdamore/mangos"
 	"github.com/gdamore/mangos/protocol/respondent"
 	"github.com/gdamore/mangos/transport/tcp"
-	"github.com/shirou/gopsutil/cpu"
-	"github.com/shirou/gopsutil/load"
 )
 
 func getPrivateIP() string {
@@ -38,12 +43,33 @@ func getPrivateIP() string {
 	return ip
 }
 
-func startNode(masterHost, name string) {
+// Look up this droplet's ID from the Digital Ocean metadata service, returning 0 if unavailable
+func getDropletID() int {
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://169.254.169.254/metadata/v1/id")
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return 0
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+func startNode(masterHost, name, pool string, dropletID int, collector *hostCollector, plugins *pluginRunner) {
 	var sock mangos.Socket
 	var err error
 	var msg []byte
 	masterUrl := url.URL{Scheme: "tcp", Host: masterHost}
 	ip := getPrivateIP()
+	hostname, _ := os.Hostname()
 
 	// Try to get new "respondent" socket
 	if sock, err = respondent.NewSocket(); err != nil {
@@ -65,30 +91,39 @@ func startNode(masterHost, name string) {
 		}
 		fmt.Printf("Client(%s): Received \"%s\" survey request\n", name, string(msg))
 
-		var loadAvg *load.LoadAvgStat
-		if loadAvg, err = load.LoadAvg(); err != nil {
-			utils.Die("Cannot get load average: %s", err.Error())
+		var survey *protocol.Survey
+		if survey, err = protocol.DecodeSurvey(msg); err != nil {
+			fmt.Printf("Client(%s): Ignoring survey: %s\n", name, err.Error())
+			continue
+		}
+		var version int
+		if version, err = protocol.Negotiate(survey); err != nil {
+			fmt.Printf("Client(%s): Ignoring survey: %s\n", name, err.Error())
+			continue
 		}
 
-		var cpuInfo []cpu.CPUInfoStat
-		if cpuInfo, err = cpu.CPUInfo(); err != nil {
-			utils.Die("Cannot get CPU info: %s", err.Error())
+		metrics := collector.Collect()
+		if plugins != nil {
+			plugins.addTo(metrics)
 		}
-		fmt.Printf("CPU INFO len: %d\n", len(cpuInfo))
-
-		// Get the normalized CPU load
-		avg := loadAvg.Load1
-		cores := int32(0)
-		for _, info := range cpuInfo {
-			fmt.Printf("Inner Cores: %d\n", info.Cores)
-			cores += info.Cores
+		fmt.Printf("Load avg: %f\n", metrics[protocol.MetricLoadAvg])
+
+		report := protocol.Report{
+			WorkerID:  name,
+			Pool:      pool,
+			DropletID: dropletID,
+			Hostname:  hostname,
+			Addr:      ip,
+			Timestamp: time.Now().UTC(),
+			Metrics:   metrics,
+		}
+		var response []byte
+		if response, err = protocol.EncodeReport(report, version); err != nil {
+			utils.Die("Cannot encode survey response: %s", err.Error())
 		}
-		fmt.Printf("Load avg: %f\n", avg)
-		fmt.Printf("Cores: %d\n", cores)
-		avg = avg / float64(cores)
 
-		fmt.Printf("Client(%s): Sending survey response\n", name)
-		if err = sock.Send([]byte(fmt.Sprintf("%s,%f", ip, avg))); err != nil {
+		fmt.Printf("Client(%s): Sending survey response (protocol version %d)\n", name, version)
+		if err = sock.Send(response); err != nil {
 			utils.Die("Cannot send: %s", err.Error())
 		}
 	}
@@ -97,12 +132,28 @@ func startNode(masterHost, name string) {
 func main() {
 	host := flag.String("host", "", "the IP address and port")
 	clientId := flag.Int64("id", 1, "the id of the node")
+	pool := flag.String("pool", "", "the name of the worker pool this droplet belongs to, for masters managing several pools")
+	dropletID := flag.Int("dropletid", 0, "the ID of this droplet (looked up from the metadata service if not given)")
+	diskPath := flag.String("diskpath", "/", "the mount point to report disk usage for")
+	nic := flag.String("nic", "", "the network interface to report throughput for (defaults to all but loopback)")
+	pluginConfig := flag.String("plugins", "", "the application metrics plugin config file (JSON) to read from")
 	flag.Parse()
 
 	if *host == "" {
 		utils.Die("No host address provided")
 	}
+	if *dropletID == 0 {
+		*dropletID = getDropletID()
+	}
+
+	var plugins *pluginRunner
+	if *pluginConfig != "" {
+		var err error
+		if plugins, err = loadPlugins(*pluginConfig); err != nil {
+			utils.Die("Error loading plugins: %s", err.Error())
+		}
+	}
 
 	fmt.Printf("Starting client. Connecting to master at %s\n", *host)
-	startNode(*host, fmt.Sprintf("%d", *clientId))
+	startNode(*host, fmt.Sprintf("%d", *clientId), *pool, *dropletID, newHostCollector(*diskPath, *nic), plugins)
 }
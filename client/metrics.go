@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jstol/digital-ocean-autoscaler/protocol"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
+)
+
+// Names of the host metrics reported to the master
+const (
+	metricCPUPercent      = "cpu_percent"
+	metricLoad1           = "load1"
+	metricLoad5           = "load5"
+	metricLoad15          = "load15"
+	metricMemUsedPercent  = "mem_used_percent"
+	metricMemAvailable    = "mem_available_bytes"
+	metricSwapUsedPercent = "swap_used_percent"
+	metricDiskUsedPercent = "disk_used_percent"
+	metricDiskReadBytes   = "disk_read_bytes_per_sec"
+	metricDiskWriteBytes  = "disk_write_bytes_per_sec"
+	metricDiskReads       = "disk_reads_per_sec"
+	metricDiskWrites      = "disk_writes_per_sec"
+	metricNetRecvBytes    = "net_recv_bytes_per_sec"
+	metricNetSentBytes    = "net_sent_bytes_per_sec"
+	metricTCPConnections  = "tcp_connections"
+	metricTCPEstablished  = "tcp_established"
+	metricProcesses       = "processes"
+)
+
+// Where Linux lists block devices. Only physical disks have a "device" link in their directory
+var sysBlockDir = "/sys/block"
+
+// Partitions, and virtual devices layered over disks, by name
+var partitionOrVirtual = regexp.MustCompile(`^((s|v|xv|h)d[a-z]+[0-9]+|(nvme[0-9]+n[0-9]+|mmcblk[0-9]+)p[0-9]+|loop[0-9]+|ram[0-9]+|dm-[0-9]+|md[0-9]+)$`)
+
+// Whether a device in the IO counters is a physical disk. Partitions, and LVM, RAID and loop
+// devices, are skipped since their IO is already counted against the disks underneath
+func isPhysicalDisk(name string) bool {
+	if _, err := os.Stat(sysBlockDir); err == nil {
+		_, err = os.Stat(filepath.Join(sysBlockDir, name, "device"))
+		return err == nil
+	}
+
+	// Without sysfs, go by the device name
+	return !partitionOrVirtual.MatchString(name)
+}
+
+// Cumulative counters, kept between surveys to turn them into rates
+type ioCounters struct {
+	diskReadBytes, diskWriteBytes, diskReads, diskWrites uint64
+	netRecvBytes, netSentBytes                           uint64
+}
+
+// How often TCP connections are counted
+const connectionSampleInterval = 5 * time.Second
+
+// Collects host metrics with gopsutil
+type hostCollector struct {
+	diskPath   string
+	nic        string
+	last       *ioCounters
+	lastSample time.Time
+
+	// Latest TCP connection counts. Listing connections walks every process's file descriptors,
+	// which is too slow to do while the master waits for a survey response, so it's done in the
+	// background
+	connectionsLock sync.Mutex
+	connections     map[string]float64
+}
+
+func newHostCollector(diskPath, nic string) *hostCollector {
+	c := &hostCollector{
+		diskPath: diskPath,
+		nic:      nic,
+	}
+	go c.sampleConnections(connectionSampleInterval)
+	return c
+}
+
+func (c *hostCollector) sampleConnections(interval time.Duration) {
+	for {
+		var sample map[string]float64
+		if connections, err := net.NetConnections("tcp"); err != nil {
+			fmt.Printf("Cannot get TCP connections: %s\n", err.Error())
+		} else {
+			established := 0
+			for _, connection := range connections {
+				if connection.Status == "ESTABLISHED" {
+					established++
+				}
+			}
+			sample = map[string]float64{
+				metricTCPConnections: float64(len(connections)),
+				metricTCPEstablished: float64(established),
+			}
+		}
+
+		c.connectionsLock.Lock()
+		c.connections = sample
+		c.connectionsLock.Unlock()
+
+		time.Sleep(interval)
+	}
+}
+
+// Gather the current host metrics. Metrics that can't be read are left out rather than failing
+// the whole report
+func (c *hostCollector) Collect() map[string]float64 {
+	metrics := make(map[string]float64)
+
+	// Load averages, also normalized by the number of cores
+	if cpuInfo, err := cpu.CPUInfo(); err != nil {
+		fmt.Printf("Cannot get CPU info: %s\n", err.Error())
+	} else {
+		cores := int32(0)
+		for _, info := range cpuInfo {
+			cores += info.Cores
+		}
+		metrics[protocol.MetricCores] = float64(cores)
+
+		if loadAvg, err := load.LoadAvg(); err != nil {
+			fmt.Printf("Cannot get load average: %s\n", err.Error())
+		} else {
+			metrics[metricLoad1] = loadAvg.Load1
+			metrics[metricLoad5] = loadAvg.Load5
+			metrics[metricLoad15] = loadAvg.Load15
+			if cores > 0 {
+				metrics[protocol.MetricLoadAvg] = loadAvg.Load1 / float64(cores)
+			}
+		}
+	}
+
+	// CPU utilisation since the previous call
+	if percents, err := cpu.CPUPercent(0, false); err != nil {
+		fmt.Printf("Cannot get CPU utilisation: %s\n", err.Error())
+	} else if len(percents) > 0 {
+		metrics[metricCPUPercent] = percents[0]
+	}
+
+	if virtual, err := mem.VirtualMemory(); err != nil {
+		fmt.Printf("Cannot get memory usage: %s\n", err.Error())
+	} else {
+		metrics[metricMemUsedPercent] = virtual.UsedPercent
+		metrics[metricMemAvailable] = float64(virtual.Available)
+	}
+
+	if swap, err := mem.SwapMemory(); err != nil {
+		fmt.Printf("Cannot get swap usage: %s\n", err.Error())
+	} else {
+		metrics[metricSwapUsedPercent] = swap.UsedPercent
+	}
+
+	if usage, err := disk.DiskUsage(c.diskPath); err != nil {
+		fmt.Printf("Cannot get disk usage for %s: %s\n", c.diskPath, err.Error())
+	} else {
+		metrics[metricDiskUsedPercent] = usage.UsedPercent
+	}
+
+	c.connectionsLock.Lock()
+	for name, value := range c.connections {
+		metrics[name] = value
+	}
+	c.connectionsLock.Unlock()
+
+	if pids, err := process.Pids(); err != nil {
+		fmt.Printf("Cannot get processes: %s\n", err.Error())
+	} else {
+		metrics[metricProcesses] = float64(len(pids))
+	}
+
+	c.collectRates(metrics)
+	return metrics
+}
+
+// Disk and network throughput since the previous call
+func (c *hostCollector) collectRates(metrics map[string]float64) {
+	counters, err := c.readCounters()
+	if err != nil {
+		fmt.Printf("Cannot get IO counters: %s\n", err.Error())
+		return
+	}
+
+	now := time.Now()
+	if c.last != nil {
+		elapsed := now.Sub(c.lastSample).Seconds()
+		if elapsed > 0 {
+			rate := func(current, previous uint64) float64 {
+				if current < previous {
+					// The counter was reset
+					return 0
+				}
+				return float64(current-previous) / elapsed
+			}
+
+			metrics[metricDiskReadBytes] = rate(counters.diskReadBytes, c.last.diskReadBytes)
+			metrics[metricDiskWriteBytes] = rate(counters.diskWriteBytes, c.last.diskWriteBytes)
+			metrics[metricDiskReads] = rate(counters.diskReads, c.last.diskReads)
+			metrics[metricDiskWrites] = rate(counters.diskWrites, c.last.diskWrites)
+			metrics[metricNetRecvBytes] = rate(counters.netRecvBytes, c.last.netRecvBytes)
+			metrics[metricNetSentBytes] = rate(counters.netSentBytes, c.last.netSentBytes)
+		}
+	}
+
+	c.last = counters
+	c.lastSample = now
+}
+
+func (c *hostCollector) readCounters() (*ioCounters, error) {
+	counters := &ioCounters{}
+
+	disks, err := disk.DiskIOCounters()
+	if err != nil {
+		return nil, err
+	}
+	for name, d := range disks {
+		if !isPhysicalDisk(name) {
+			continue
+		}
+		counters.diskReadBytes += d.ReadBytes
+		counters.diskWriteBytes += d.WriteBytes
+		counters.diskReads += d.ReadCount
+		counters.diskWrites += d.WriteCount
+	}
+
+	nics, err := net.NetIOCounters(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, nic := range nics {
+		// Count every interface except loopback, unless one was asked for
+		if (c.nic == "" && nic.Name != "lo") || nic.Name == c.nic {
+			counters.netRecvBytes += nic.BytesRecv
+			counters.netSentBytes += nic.BytesSent
+		}
+	}
+
+	return counters, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsPhysicalDisk(t *testing.T) {
+	defer func(dir string) { sysBlockDir = dir }(sysBlockDir)
+
+	// A sysfs layout with a disk, one of its partitions and an LVM volume on top
+	dir, err := ioutil.TempDir("", "sysblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, path := range []string{"vda/device", "vda/vda1", "dm-0"} {
+		if err = os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		sysBlock string
+		name     string
+		want     bool
+	}{
+		{dir, "vda", true},
+		{dir, "vda1", false},
+		{dir, "dm-0", false},
+		{dir, "sdb", false},
+		{"/nonexistent", "sda", true},
+		{"/nonexistent", "sda1", false},
+		{"/nonexistent", "nvme0n1", true},
+		{"/nonexistent", "nvme0n1p2", false},
+		{"/nonexistent", "xvdb", true},
+		{"/nonexistent", "loop3", false},
+	}
+	for _, test := range tests {
+		sysBlockDir = test.sysBlock
+		if got := isPhysicalDisk(test.name); got != test.want {
+			t.Errorf("isPhysicalDisk(%s) under %s = %t, want %t", test.name, test.sysBlock, got, test.want)
+		}
+	}
+}
+
+func TestCollectReportsSampledConnections(t *testing.T) {
+	c := &hostCollector{
+		diskPath:    "/",
+		connections: map[string]float64{metricTCPConnections: 12, metricTCPEstablished: 7},
+	}
+	metrics := c.Collect()
+	if metrics[metricTCPConnections] != 12 || metrics[metricTCPEstablished] != 7 {
+		t.Errorf("connections %g, established %g, want the sampled 12 and 7",
+			metrics[metricTCPConnections], metrics[metricTCPEstablished])
+	}
+}
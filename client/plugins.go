@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultPluginInterval = 5 * time.Second
+	defaultPluginTimeout  = 2 * time.Second
+	statsdErrorBackoff    = time.Second
+)
+
+// Configuration for one application metrics plugin
+type pluginConfig struct {
+	// "http", "statsd" or "command"
+	Type string `json:"type"`
+	// Prepended to every metric name the plugin produces
+	Prefix string `json:"prefix"`
+	// How often (in seconds) to scrape or run the plugin, and how long to let it take
+	Interval int64 `json:"interval"`
+	Timeout  int64 `json:"timeout"`
+
+	// http: the endpoint to scrape and its format, "prometheus" (the default) or "json"
+	URL    string `json:"url"`
+	Format string `json:"format"`
+	// statsd: the UDP address to listen on
+	Addr string `json:"addr"`
+	// command: the shell command to run. Output lines are "name value" pairs; a line holding
+	// only a number is reported under Name
+	Command string `json:"command"`
+	Name    string `json:"name"`
+}
+
+// Source of application metrics
+type plugin interface {
+	Collect() (map[string]float64, error)
+}
+
+// Runs the configured plugins in the background and keeps their latest metrics, so answering a
+// survey never waits on a slow endpoint
+type pluginRunner struct {
+	lock    sync.Mutex
+	metrics map[string]map[string]float64
+}
+
+func loadPlugins(path string) (*pluginRunner, error) {
+	var configs []pluginConfig
+
+	jsonData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plugin config: %s", err)
+	}
+	if err = json.Unmarshal(jsonData, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing plugin config: %s", err)
+	}
+
+	runner := &pluginRunner{metrics: make(map[string]map[string]float64)}
+	for i, config := range configs {
+		interval := time.Duration(config.Interval) * time.Second
+		if interval <= 0 {
+			interval = defaultPluginInterval
+		}
+		timeout := time.Duration(config.Timeout) * time.Second
+		if timeout <= 0 {
+			timeout = defaultPluginTimeout
+		}
+
+		var p plugin
+		switch config.Type {
+		case "http":
+			if config.URL == "" {
+				return nil, fmt.Errorf("http plugin %d is missing a url", i)
+			}
+			if config.Format != "" && config.Format != "prometheus" && config.Format != "json" {
+				return nil, fmt.Errorf("http plugin %d has unknown format '%s'", i, config.Format)
+			}
+			p = &httpPlugin{config.URL, config.Format, &http.Client{Timeout: timeout}}
+		case "statsd":
+			if p, err = newStatsdPlugin(config.Addr); err != nil {
+				return nil, err
+			}
+		case "command":
+			if config.Command == "" {
+				return nil, fmt.Errorf("command plugin %d is missing a command", i)
+			}
+			p = &commandPlugin{config.Command, config.Name, timeout}
+		default:
+			return nil, fmt.Errorf("plugin %d has unknown type '%s'", i, config.Type)
+		}
+
+		go runner.run(fmt.Sprintf("%s-%d", config.Type, i), config.Prefix, p, interval)
+	}
+
+	return runner, nil
+}
+
+func (r *pluginRunner) run(key, prefix string, p plugin, interval time.Duration) {
+	for {
+		metrics, err := p.Collect()
+		if err != nil {
+			fmt.Printf("Plugin %s failed: %s\n", key, err.Error())
+			metrics = nil
+		}
+
+		prefixed := make(map[string]float64)
+		for name, value := range metrics {
+			prefixed[prefix+name] = value
+		}
+
+		r.lock.Lock()
+		r.metrics[key] = prefixed
+		r.lock.Unlock()
+
+		time.Sleep(interval)
+	}
+}
+
+// Copy the latest plugin metrics into a report's metrics
+func (r *pluginRunner) addTo(metrics map[string]float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, pluginMetrics := range r.metrics {
+		for name, value := range pluginMetrics {
+			metrics[name] = value
+		}
+	}
+}
+
+// Scrapes a local HTTP endpoint in the Prometheus text format or as JSON
+type httpPlugin struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+func (p *httpPlugin) Collect() (map[string]float64, error) {
+	resp, err := p.client.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", p.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.format == "json" {
+		return parseJSONMetrics(body)
+	}
+	return parsePrometheusMetrics(body)
+}
+
+// Parse the Prometheus text exposition format. Series keep their labels in their name, e.g.
+// request_latency_seconds{quantile="0.95"}
+func parsePrometheusMetrics(body []byte) (map[string]float64, error) {
+	metrics := make(map[string]float64)
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// The series name runs up to the closing brace of the labels, if there are any
+		nameEnd := strings.IndexAny(line, " \t")
+		if brace := strings.Index(line, "{"); brace >= 0 && (nameEnd < 0 || brace < nameEnd) {
+			nameEnd = strings.Index(line, "}") + 1
+		}
+		if nameEnd <= 0 {
+			continue
+		}
+
+		fields := strings.Fields(line[nameEnd:])
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || math.IsNaN(value) {
+			continue
+		}
+		metrics[line[:nameEnd]] = value
+	}
+
+	return metrics, scanner.Err()
+}
+
+// Parse a JSON document, flattening nested objects into dot separated names
+func parseJSONMetrics(body []byte) (map[string]float64, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, err
+	}
+
+	metrics := make(map[string]float64)
+	flattenJSON("", document, metrics)
+	return metrics, nil
+}
+
+func flattenJSON(prefix string, value interface{}, metrics map[string]float64) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenJSON(key, child, metrics)
+		}
+	case float64:
+		metrics[prefix] = v
+	case bool:
+		if v {
+			metrics[prefix] = 1
+		} else {
+			metrics[prefix] = 0
+		}
+	}
+}
+
+// Runs a shell command and reads metrics from its output
+type commandPlugin struct {
+	command string
+	name    string
+	timeout time.Duration
+}
+
+func (p *commandPlugin) Collect() (map[string]float64, error) {
+	// The command runs in its own process group so a timeout kills anything it started too
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", p.command)
+	cmd.Stdout = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("'%s': %s", p.command, err)
+	}
+
+	timer := time.AfterFunc(p.timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	if !timer.Stop() {
+		return nil, fmt.Errorf("'%s' timed out after %s", p.command, p.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %s", p.command, err)
+	}
+
+	metrics := make(map[string]float64)
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 1:
+			if value, err := strconv.ParseFloat(fields[0], 64); err == nil && p.name != "" {
+				metrics[p.name] = value
+			}
+		case 2:
+			if value, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				metrics[fields[0]] = value
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// Listens for statsd packets. Gauges report their latest value and counters their total since the
+// previous collection, or 0 once they go quiet. Timers report the count, mean, 95th percentile
+// and max of the values received since the previous collection
+type statsdPlugin struct {
+	lock     sync.Mutex
+	gauges   map[string]float64
+	counters map[string]float64
+	timers   map[string][]float64
+}
+
+func newStatsdPlugin(addr string) (*statsdPlugin, error) {
+	if addr == "" {
+		addr = "127.0.0.1:8125"
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for statsd on %s: %s", addr, err)
+	}
+
+	p := &statsdPlugin{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]float64),
+		timers:   make(map[string][]float64),
+	}
+	go p.listen(conn)
+	return p, nil
+}
+
+// Read packets until the connection is closed, backing off after other errors
+func (p *statsdPlugin) listen(conn net.PacketConn) {
+	buffer := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error reading statsd packet: %s\n", err.Error())
+			time.Sleep(statsdErrorBackoff)
+			continue
+		}
+		for _, line := range strings.Split(string(buffer[:n]), "\n") {
+			p.handle(strings.TrimSpace(line))
+		}
+	}
+}
+
+// Record a "name:value|type[|@rate]" line
+func (p *statsdPlugin) handle(line string) {
+	colon := strings.LastIndex(line, ":")
+	if colon <= 0 {
+		return
+	}
+	name := line[:colon]
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return
+	}
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return
+	}
+
+	rate := 1.0
+	if len(parts) > 2 && strings.HasPrefix(parts[2], "@") {
+		if r, err := strconv.ParseFloat(parts[2][1:], 64); err == nil && r > 0 {
+			rate = r
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch parts[1] {
+	case "g":
+		// Gauges prefixed with a sign are adjusted rather than set
+		if strings.HasPrefix(parts[0], "+") || strings.HasPrefix(parts[0], "-") {
+			p.gauges[name] += value
+		} else {
+			p.gauges[name] = value
+		}
+	case "c":
+		p.counters[name] += value / rate
+	case "ms", "h":
+		p.timers[name] = append(p.timers[name], value)
+	}
+}
+
+func (p *statsdPlugin) Collect() (map[string]float64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	metrics := make(map[string]float64)
+	for name, value := range p.gauges {
+		metrics[name] = value
+	}
+	for name, value := range p.counters {
+		metrics[name] = value
+	}
+	for name, values := range p.timers {
+		sort.Float64s(values)
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		metrics[name+".count"] = float64(len(values))
+		metrics[name+".mean"] = sum / float64(len(values))
+		metrics[name+".p95"] = values[int(math.Ceil(0.95*float64(len(values))))-1]
+		metrics[name+".max"] = values[len(values)-1]
+	}
+
+	for name := range p.counters {
+		p.counters[name] = 0
+	}
+	p.timers = make(map[string][]float64)
+	return metrics, nil
+}
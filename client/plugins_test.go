@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdCounters(t *testing.T) {
+	p := &statsdPlugin{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]float64),
+		timers:   make(map[string][]float64),
+	}
+	p.handle("jobs:3|c")
+	p.handle("jobs:1|c|@0.5")
+	p.handle("queue_depth:7|g")
+
+	metrics, _ := p.Collect()
+	if metrics["jobs"] != 5 || metrics["queue_depth"] != 7 {
+		t.Errorf("first collection %v, want jobs 5 and queue_depth 7", metrics)
+	}
+
+	// A counter that goes quiet reports 0 rather than disappearing
+	metrics, _ = p.Collect()
+	if value, ok := metrics["jobs"]; !ok || value != 0 {
+		t.Errorf("idle counter reported %v (present %t), want 0", value, ok)
+	}
+}
+
+func TestStatsdStopsWhenClosed(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &statsdPlugin{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]float64),
+		timers:   make(map[string][]float64),
+	}
+	stopped := make(chan bool)
+	go func() {
+		p.listen(conn)
+		close(stopped)
+	}()
+
+	conn.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("still listening after the connection was closed")
+	}
+}
+
+func TestCommandPlugin(t *testing.T) {
+	p := &commandPlugin{"echo 4; echo sessions 12", "connections", time.Second}
+	metrics, err := p.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics["connections"] != 4 || metrics["sessions"] != 12 {
+		t.Errorf("metrics %v", metrics)
+	}
+}
+
+func TestCommandPluginTimeout(t *testing.T) {
+	// The background sleep holds on to the output, so the collection only returns once it's
+	// killed along with the shell
+	p := &commandPlugin{"sleep 10 & sleep 10; echo 1", "value", 100 * time.Millisecond}
+
+	start := time.Now()
+	_, err := p.Collect()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("collection took %s, the command's children weren't killed", elapsed)
+	}
+}
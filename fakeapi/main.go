@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jstol/digital-ocean-autoscaler/fakedo"
+	"github.com/jstol/digital-ocean-autoscaler/utils"
+)
+
+func main() {
+	host := flag.String("host", "localhost:8080", "the IP address and port to serve the fake API on")
+	bootTime := flag.Int64("boottime", 10, "the amount of time (in seconds) new droplets stay in the 'new' state")
+	token := flag.String("token", "", "if set, the API token clients must present")
+	droplets := flag.String("droplets", "", "a comma separated list of active droplets to start with")
+	tag := flag.String("tag", "", "a tag to apply to the initial droplets")
+	loadBalancer := flag.String("loadbalancer", "", "if set, the name of an empty load balancer to start with")
+	flag.Parse()
+
+	server := fakedo.NewServer(time.Duration(*bootTime) * time.Second)
+	server.Token = *token
+
+	if *droplets != "" {
+		for _, name := range strings.Split(*droplets, ",") {
+			var tags []string
+			if *tag != "" {
+				tags = append(tags, *tag)
+			}
+			droplet := server.AddDroplet(strings.TrimSpace(name), tags...)
+			fmt.Printf("Seeded droplet %s (id=%d)\n", droplet.Name, droplet.ID)
+		}
+	}
+
+	if *loadBalancer != "" {
+		lb := server.AddLoadBalancer(*loadBalancer)
+		fmt.Printf("Seeded load balancer %s (id=%s)\n", lb.Name, lb.ID)
+	}
+
+	fmt.Printf("Serving fake Digital Ocean API at http://%s/\n", *host)
+	if err := http.ListenAndServe(*host, server); err != nil {
+		utils.Die("Error serving fake API: %s", err.Error())
+	}
+}
@@ -0,0 +1,545 @@
+// Package fakedo implements an in-memory stand-in for the subset of the Digital Ocean v2
+// droplets and load balancer APIs used by the autoscaler, so the master can be run without a
+// real account. Listing supports pagination and filtering by tag.
+package fakedo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 200
+)
+
+type region struct {
+	Slug      string `json:"slug"`
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+}
+
+type image struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Slug         string `json:"slug"`
+	Distribution string `json:"distribution"`
+}
+
+type networkV4 struct {
+	IPAddress string `json:"ip_address"`
+	Netmask   string `json:"netmask"`
+	Gateway   string `json:"gateway"`
+	Type      string `json:"type"`
+}
+
+type networkV6 struct {
+	IPAddress string `json:"ip_address"`
+	Netmask   int    `json:"netmask"`
+	Gateway   string `json:"gateway"`
+	Type      string `json:"type"`
+}
+
+type networks struct {
+	V4 []networkV4 `json:"v4"`
+	V6 []networkV6 `json:"v6"`
+}
+
+// Droplet as serialized by the API
+type Droplet struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	Memory   int      `json:"memory"`
+	Vcpus    int      `json:"vcpus"`
+	Disk     int      `json:"disk"`
+	Locked   bool     `json:"locked"`
+	Status   string   `json:"status"`
+	Created  string   `json:"created_at"`
+	Region   region   `json:"region"`
+	Image    image    `json:"image"`
+	SizeSlug string   `json:"size_slug"`
+	Networks networks `json:"networks"`
+	Tags     []string `json:"tags"`
+	UserData string   `json:"-"`
+
+	created time.Time
+}
+
+// Load balancer as serialized by the API
+type LoadBalancer struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	IP         string `json:"ip"`
+	Status     string `json:"status"`
+	Created    string `json:"created_at"`
+	Region     region `json:"region"`
+	DropletIDs []int  `json:"droplet_ids"`
+}
+
+type dropletIDsRequest struct {
+	IDs []int `json:"droplet_ids"`
+}
+
+type createRequest struct {
+	Name              string          `json:"name"`
+	Names             []string        `json:"names"`
+	Region            string          `json:"region"`
+	Size              string          `json:"size"`
+	Image             json.RawMessage `json:"image"`
+	IPv6              bool            `json:"ipv6"`
+	PrivateNetworking bool            `json:"private_networking"`
+	UserData          string          `json:"user_data"`
+	Tags              []string        `json:"tags"`
+}
+
+type pages struct {
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+type links struct {
+	Pages *pages `json:"pages,omitempty"`
+}
+
+type meta struct {
+	Total int `json:"total"`
+}
+
+type errorResponse struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+// Server is an http.Handler serving the fake droplets API under /v2/
+type Server struct {
+	// Time a created droplet spends in the "new" state before becoming "active"
+	BootTime time.Duration
+	// If set, requests must carry this bearer token
+	Token string
+
+	mu            sync.Mutex
+	droplets      map[int]*Droplet
+	loadBalancers map[string]*LoadBalancer
+	nextID        int
+}
+
+func NewServer(bootTime time.Duration) *Server {
+	return &Server{
+		BootTime:      bootTime,
+		droplets:      make(map[int]*Droplet),
+		loadBalancers: make(map[string]*LoadBalancer),
+		nextID:        1000,
+	}
+}
+
+// Add an already active droplet, e.g. to stand in for pre-existing workers
+func (s *Server) AddDroplet(name string, tags ...string) Droplet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	droplet := s.newDroplet(name, "tor1", "512mb", image{Slug: "ubuntu-14-04-x64"}, true, tags)
+	droplet.Status = "active"
+	return *droplet
+}
+
+// Snapshot of every droplet currently held by the server, ordered by ID
+func (s *Server) Droplets() []Droplet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var droplets []Droplet
+	for _, droplet := range s.sortedDroplets() {
+		droplets = append(droplets, *droplet)
+	}
+	return droplets
+}
+
+// Add an empty, active load balancer
+func (s *Server) AddLoadBalancer(name string) LoadBalancer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	loadBalancer := &LoadBalancer{
+		ID:         fmt.Sprintf("4de7ac8b-495b-4884-9a69-%012d", s.nextID),
+		Name:       name,
+		IP:         fmt.Sprintf("198.51.100.%d", s.nextID%254+1),
+		Status:     "active",
+		Created:    time.Now().UTC().Format(time.RFC3339),
+		Region:     region{"tor1", "tor1", true},
+		DropletIDs: []int{},
+	}
+	s.loadBalancers[loadBalancer.ID] = loadBalancer
+	return *loadBalancer
+}
+
+// Snapshot of a load balancer, and whether it exists
+func (s *Server) LoadBalancer(id string) (LoadBalancer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loadBalancer, ok := s.loadBalancers[id]
+	if !ok {
+		return LoadBalancer{}, false
+	}
+	copied := *loadBalancer
+	copied.DropletIDs = append([]int{}, loadBalancer.DropletIDs...)
+	return copied, true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unable to authenticate you.")
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "v2/droplets" && r.Method == "GET":
+		s.listDroplets(w, r)
+	case path == "v2/droplets" && r.Method == "POST":
+		s.createDroplets(w, r)
+	case strings.HasPrefix(path, "v2/droplets/"):
+		id, err := strconv.Atoi(strings.TrimPrefix(path, "v2/droplets/"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+			return
+		}
+		switch r.Method {
+		case "GET":
+			s.getDroplet(w, id)
+		case "DELETE":
+			s.deleteDroplet(w, id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed.")
+		}
+	case strings.HasPrefix(path, "v2/load_balancers/"):
+		parts := strings.Split(strings.TrimPrefix(path, "v2/load_balancers/"), "/")
+		switch {
+		case len(parts) == 1 && r.Method == "GET":
+			s.getLoadBalancer(w, parts[0])
+		case len(parts) == 2 && parts[1] == "droplets" && (r.Method == "POST" || r.Method == "DELETE"):
+			s.changeLoadBalancerDroplets(w, r, parts[0], r.Method == "POST")
+		default:
+			writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+	}
+}
+
+func (s *Server) listDroplets(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := r.URL.Query()
+	page := intParam(query, "page", 1)
+	perPage := intParam(query, "per_page", defaultPerPage)
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	// Optionally filter down to the droplets carrying a tag
+	var all []*Droplet
+	tag := query.Get("tag_name")
+	for _, droplet := range s.sortedDroplets() {
+		s.advance(droplet)
+		if tag == "" || hasTag(droplet, tag) {
+			all = append(all, droplet)
+		}
+	}
+
+	start := (page - 1) * perPage
+	end := start + perPage
+	if start > len(all) {
+		start = len(all)
+	}
+	if end > len(all) {
+		end = len(all)
+	}
+
+	droplets := []Droplet{}
+	for _, droplet := range all[start:end] {
+		droplets = append(droplets, *droplet)
+	}
+
+	lastPage := (len(all) + perPage - 1) / perPage
+	writeJSON(w, http.StatusOK, struct {
+		Droplets []Droplet `json:"droplets"`
+		Links    links     `json:"links"`
+		Meta     meta      `json:"meta"`
+	}{droplets, links{pageLinks(r, page, lastPage, perPage)}, meta{len(all)}})
+}
+
+func (s *Server) createDroplets(w http.ResponseWriter, r *http.Request) {
+	var request createRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", err.Error())
+		return
+	}
+
+	names := request.Names
+	if request.Name != "" {
+		names = []string{request.Name}
+	}
+	if len(names) == 0 || request.Region == "" || request.Size == "" || len(request.Image) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "Name, region, size and image are required.")
+		return
+	}
+
+	// The image may be given either as a slug or as a numeric ID
+	var img image
+	if err := json.Unmarshal(request.Image, &img.Slug); err != nil {
+		if err = json.Unmarshal(request.Image, &img.ID); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "Invalid image.")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var created []Droplet
+	for _, name := range names {
+		droplet := s.newDroplet(name, request.Region, request.Size, img, request.PrivateNetworking, request.Tags)
+		droplet.UserData = request.UserData
+		if request.IPv6 {
+			droplet.Networks.V6 = append(droplet.Networks.V6, networkV6{
+				IPAddress: fmt.Sprintf("2001:db8::%x", droplet.ID),
+				Netmask:   64,
+				Gateway:   "2001:db8::1",
+				Type:      "public",
+			})
+		}
+		created = append(created, *droplet)
+	}
+
+	if request.Name != "" {
+		writeJSON(w, http.StatusAccepted, struct {
+			Droplet Droplet `json:"droplet"`
+		}{created[0]})
+	} else {
+		writeJSON(w, http.StatusAccepted, struct {
+			Droplets []Droplet `json:"droplets"`
+		}{created})
+	}
+}
+
+func (s *Server) getDroplet(w http.ResponseWriter, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	droplet, ok := s.droplets[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+		return
+	}
+	s.advance(droplet)
+
+	writeJSON(w, http.StatusOK, struct {
+		Droplet Droplet `json:"droplet"`
+	}{*droplet})
+}
+
+func (s *Server) deleteDroplet(w http.ResponseWriter, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.droplets[id]; !ok {
+		writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+		return
+	}
+	delete(s.droplets, id)
+
+	// Deleted droplets drop out of every load balancer
+	for _, loadBalancer := range s.loadBalancers {
+		loadBalancer.DropletIDs = withoutIDs(loadBalancer.DropletIDs, map[int]bool{id: true})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getLoadBalancer(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loadBalancer, ok := s.loadBalancers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		LoadBalancer LoadBalancer `json:"load_balancer"`
+	}{*loadBalancer})
+}
+
+// Add droplets to a load balancer, or remove them
+func (s *Server) changeLoadBalancerDroplets(w http.ResponseWriter, r *http.Request, id string, add bool) {
+	var request dropletIDsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loadBalancer, ok := s.loadBalancers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+		return
+	}
+	if len(request.IDs) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "droplet_ids is required.")
+		return
+	}
+
+	ids := make(map[int]bool)
+	for _, dropletID := range request.IDs {
+		if _, exists := s.droplets[dropletID]; !exists && add {
+			writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", fmt.Sprintf("Droplet %d does not exist.", dropletID))
+			return
+		}
+		ids[dropletID] = true
+	}
+
+	// Adding a droplet that's already there is a no-op, as with the real API
+	loadBalancer.DropletIDs = withoutIDs(loadBalancer.DropletIDs, ids)
+	if add {
+		for dropletID := range ids {
+			loadBalancer.DropletIDs = append(loadBalancer.DropletIDs, dropletID)
+		}
+		sort.Ints(loadBalancer.DropletIDs)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func withoutIDs(ids []int, remove map[int]bool) []int {
+	kept := []int{}
+	for _, id := range ids {
+		if !remove[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// Must be called with the lock held
+func (s *Server) newDroplet(name, regionSlug, size string, img image, privateNetworking bool, tags []string) *Droplet {
+	s.nextID++
+	id := s.nextID
+	now := time.Now().UTC()
+
+	droplet := &Droplet{
+		ID:       id,
+		Name:     name,
+		Memory:   512,
+		Vcpus:    1,
+		Disk:     20,
+		Status:   "new",
+		Created:  now.Format(time.RFC3339),
+		Region:   region{regionSlug, regionSlug, true},
+		Image:    img,
+		SizeSlug: size,
+		Tags:     append([]string{}, tags...),
+		created:  now,
+	}
+
+	// Hand out addresses from the documentation ranges, derived from the droplet ID
+	droplet.Networks.V4 = []networkV4{{
+		IPAddress: fmt.Sprintf("192.0.2.%d", id%254+1),
+		Netmask:   "255.255.255.0",
+		Gateway:   "192.0.2.254",
+		Type:      "public",
+	}}
+	if privateNetworking {
+		droplet.Networks.V4 = append(droplet.Networks.V4, networkV4{
+			IPAddress: fmt.Sprintf("10.%d.%d.%d", (id>>16)&0xff, (id>>8)&0xff, id&0xff),
+			Netmask:   "255.0.0.0",
+			Gateway:   "10.0.0.1",
+			Type:      "private",
+		})
+	}
+
+	s.droplets[id] = droplet
+	return droplet
+}
+
+// Move a droplet from "new" to "active" once it has finished booting
+func (s *Server) advance(droplet *Droplet) {
+	if droplet.Status == "new" && time.Since(droplet.created) >= s.BootTime {
+		droplet.Status = "active"
+	}
+}
+
+func (s *Server) sortedDroplets() []*Droplet {
+	droplets := make([]*Droplet, 0, len(s.droplets))
+	for _, droplet := range s.droplets {
+		droplets = append(droplets, droplet)
+	}
+	sort.Slice(droplets, func(i, j int) bool { return droplets[i].ID < droplets[j].ID })
+	return droplets
+}
+
+func hasTag(droplet *Droplet, tag string) bool {
+	for _, t := range droplet.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func pageLinks(r *http.Request, page, lastPage, perPage int) *pages {
+	if lastPage <= 1 {
+		return nil
+	}
+
+	pageURL := func(n int) string {
+		u := url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path}
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(n))
+		query.Set("per_page", strconv.Itoa(perPage))
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+
+	p := &pages{}
+	if page > 1 {
+		p.First = pageURL(1)
+		p.Prev = pageURL(page - 1)
+	}
+	if page < lastPage {
+		p.Next = pageURL(page + 1)
+		p.Last = pageURL(lastPage)
+	}
+	return p
+}
+
+func intParam(query url.Values, key string, fallback int) int {
+	if value, err := strconv.Atoi(query.Get(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, id, message string) {
+	writeJSON(w, status, errorResponse{id, message})
+}
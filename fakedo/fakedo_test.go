@@ -0,0 +1,180 @@
+package fakedo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type listResponse struct {
+	Droplets []Droplet `json:"droplets"`
+	Links    links     `json:"links"`
+	Meta     meta      `json:"meta"`
+}
+
+func get(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decoding %s: %s", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func send(t *testing.T, method, url, body string) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPagination(t *testing.T) {
+	server := NewServer(0)
+	for i := 0; i < 5; i++ {
+		server.AddDroplet(fmt.Sprintf("web-%d", i))
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	var pages [][]string
+	url := ts.URL + "/v2/droplets?per_page=2"
+	for url != "" {
+		var list listResponse
+		get(t, url, &list)
+		if list.Meta.Total != 5 {
+			t.Errorf("total %d, want 5", list.Meta.Total)
+		}
+
+		var names []string
+		for _, droplet := range list.Droplets {
+			names = append(names, droplet.Name)
+		}
+		pages = append(pages, names)
+
+		url = ""
+		if list.Links.Pages != nil {
+			url = list.Links.Pages.Next
+		}
+	}
+
+	if got := fmt.Sprint(pages); got != "[[web-0 web-1] [web-2 web-3] [web-4]]" {
+		t.Errorf("pages %s", got)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	server := NewServer(0)
+	server.AddDroplet("web-1", "web")
+	server.AddDroplet("api-1", "api")
+	server.AddDroplet("web-2", "web", "api")
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	var list listResponse
+	get(t, ts.URL+"/v2/droplets?tag_name=web", &list)
+	if len(list.Droplets) != 2 || list.Droplets[0].Name != "web-1" || list.Droplets[1].Name != "web-2" {
+		t.Errorf("tagged web: %+v", list.Droplets)
+	}
+}
+
+func TestBoot(t *testing.T) {
+	server := NewServer(50 * time.Millisecond)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v2/droplets", "application/json",
+		strings.NewReader(`{"name": "web-1", "region": "tor1", "size": "512mb", "image": "ubuntu", "tags": ["web"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		Droplet Droplet `json:"droplet"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || created.Droplet.Status != "new" {
+		t.Fatalf("create: status %d, droplet %+v", resp.StatusCode, created.Droplet)
+	}
+
+	url := fmt.Sprintf("%s/v2/droplets/%d", ts.URL, created.Droplet.ID)
+	time.Sleep(60 * time.Millisecond)
+	var fetched struct {
+		Droplet Droplet `json:"droplet"`
+	}
+	get(t, url, &fetched)
+	if fetched.Droplet.Status != "active" {
+		t.Errorf("status after booting %s, want active", fetched.Droplet.Status)
+	}
+
+	if code := send(t, "DELETE", url, ""); code != http.StatusNoContent {
+		t.Errorf("delete: status %d", code)
+	}
+	if code := get(t, url, nil); code != http.StatusNotFound {
+		t.Errorf("get after delete: status %d", code)
+	}
+}
+
+func TestToken(t *testing.T) {
+	server := NewServer(0)
+	server.Token = "secret"
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	if code := get(t, ts.URL+"/v2/droplets", nil); code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d", code)
+	}
+}
+
+func TestLoadBalancer(t *testing.T) {
+	server := NewServer(0)
+	web1 := server.AddDroplet("web-1")
+	web2 := server.AddDroplet("web-2")
+	lb := server.AddLoadBalancer("web")
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	url := ts.URL + "/v2/load_balancers/" + lb.ID
+	body := fmt.Sprintf(`{"droplet_ids": [%d, %d]}`, web1.ID, web2.ID)
+	if code := send(t, "POST", url+"/droplets", body); code != http.StatusNoContent {
+		t.Fatalf("add: status %d", code)
+	}
+	if code := send(t, "POST", url+"/droplets", `{"droplet_ids": [1]}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("adding a missing droplet: status %d", code)
+	}
+
+	var fetched struct {
+		LoadBalancer LoadBalancer `json:"load_balancer"`
+	}
+	get(t, url, &fetched)
+	if got := fmt.Sprint(fetched.LoadBalancer.DropletIDs); got != fmt.Sprint([]int{web1.ID, web2.ID}) {
+		t.Errorf("droplets after adding %s", got)
+	}
+
+	if code := send(t, "DELETE", url+"/droplets", fmt.Sprintf(`{"droplet_ids": [%d]}`, web1.ID)); code != http.StatusNoContent {
+		t.Fatalf("remove: status %d", code)
+	}
+	// Deleting a droplet takes it out of the load balancer too
+	send(t, "DELETE", fmt.Sprintf("%s/v2/droplets/%d", ts.URL, web2.ID), "")
+	if current, _ := server.LoadBalancer(lb.ID); len(current.DropletIDs) != 0 {
+		t.Errorf("droplets after removing %v", current.DropletIDs)
+	}
+
+	if code := get(t, ts.URL+"/v2/load_balancers/missing", nil); code != http.StatusNotFound {
+		t.Errorf("missing load balancer: status %d", code)
+	}
+}
@@ -0,0 +1,344 @@
+// Package haproxy is a client for the HAProxy runtime API, spoken over the stats socket.
+//
+// Each call opens a connection, sends its commands separated by semicolons and reads the
+// responses until HAProxy closes the connection. HAProxy ends every response with an empty line,
+// which is how the responses in a batch are told apart.
+package haproxy
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Success responses of the commands this package builds. HAProxy reports errors as plain output
+// rather than failing, so any other output is an error. Output of other commands isn't checked
+var commandChecks = []struct {
+	// Leading words of the command. An empty word matches anything
+	words     []string
+	succeeded func(output string) bool
+}{
+	{[]string{"set", "weight"}, isEmpty},
+	{[]string{"set", "server", "", "state"}, isEmpty},
+	{[]string{"set", "server", "", "addr"}, func(output string) bool {
+		return strings.HasPrefix(output, "IP changed from ") || strings.HasPrefix(output, "no need to change the addr")
+	}},
+	{[]string{"add", "server"}, func(output string) bool { return output == "New server registered." }},
+	{[]string{"del", "server"}, func(output string) bool { return output == "Server deleted." }},
+	{[]string{"show", "stat"}, func(output string) bool { return strings.HasPrefix(output, "# ") }},
+	{[]string{"show", "servers", "state"}, func(output string) bool {
+		lines := strings.SplitN(output, "\n", 3)
+		return len(lines) >= 2 && strings.HasPrefix(lines[1], "# ")
+	}},
+}
+
+func isEmpty(output string) bool {
+	return output == ""
+}
+
+// Error reported by HAProxy for a single command
+type CommandError struct {
+	Command string
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("'%s': %s", e.Command, e.Message)
+}
+
+// Output of one command in a batch
+type Response struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+type Client struct {
+	network, address string
+	Timeout          time.Duration
+}
+
+// Create a client for a runtime API address: a UNIX socket path (optionally prefixed with
+// "unix://"), or "tcp://host:port"
+func NewClient(address string) *Client {
+	client := &Client{network: "unix", address: address, Timeout: defaultTimeout}
+	if strings.HasPrefix(address, "tcp://") {
+		client.network, client.address = "tcp", strings.TrimPrefix(address, "tcp://")
+	} else {
+		client.address = strings.TrimPrefix(address, "unix://")
+	}
+	return client
+}
+
+func (c *Client) String() string {
+	return c.network + "://" + c.address
+}
+
+// Run several commands over one connection. The error is only set if HAProxy couldn't be
+// reached; errors from individual commands are in their responses
+func (c *Client) Batch(commands ...string) ([]Response, error) {
+	if len(commands) == 0 {
+		return nil, nil
+	}
+	for _, command := range commands {
+		if strings.ContainsAny(command, ";\n") {
+			return nil, fmt.Errorf("command '%s' contains a separator", command)
+		}
+	}
+
+	conn, err := net.DialTimeout(c.network, c.address, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to %s: %s", c, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	if _, err = conn.Write([]byte(strings.Join(commands, ";") + "\n")); err != nil {
+		return nil, fmt.Errorf("error sending commands to %s: %s", c, err)
+	}
+
+	// Each response is terminated by an empty line
+	responses := make([]Response, 0, len(commands))
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() && len(responses) < len(commands) {
+		line := scanner.Text()
+		if line != "" {
+			lines = append(lines, line)
+			continue
+		}
+		responses = append(responses, newResponse(commands[len(responses)], lines))
+		lines = nil
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading from %s: %s", c, err)
+	}
+
+	// Anything left over belongs to the last command if HAProxy closed without a final empty line
+	if len(lines) > 0 && len(responses) < len(commands) {
+		responses = append(responses, newResponse(commands[len(responses)], lines))
+	}
+	if len(responses) < len(commands) {
+		return responses, fmt.Errorf("%s closed the connection after %d of %d responses", c, len(responses), len(commands))
+	}
+	return responses, nil
+}
+
+func newResponse(command string, lines []string) Response {
+	response := Response{Command: command, Output: strings.Join(lines, "\n")}
+	if !succeeded(command, response.Output) {
+		response.Err = &CommandError{command, response.Output}
+	}
+	return response
+}
+
+func succeeded(command, output string) bool {
+	fields := strings.Fields(command)
+	for _, check := range commandChecks {
+		if matchWords(fields, check.words) {
+			return check.succeeded(output)
+		}
+	}
+	return true
+}
+
+func matchWords(fields, words []string) bool {
+	if len(fields) < len(words) {
+		return false
+	}
+	for i, word := range words {
+		if word != "" && fields[i] != word {
+			return false
+		}
+	}
+	return true
+}
+
+// Run a single command and return its output
+func (c *Client) Execute(command string) (string, error) {
+	responses, err := c.Batch(command)
+	if err != nil {
+		return "", err
+	}
+	return responses[0].Output, responses[0].Err
+}
+
+func SetWeightCommand(backend, server string, weight int64) string {
+	return fmt.Sprintf("set weight %s/%s %d", backend, server, weight)
+}
+
+// State is "ready", "drain" or "maint"
+func SetServerStateCommand(backend, server, state string) string {
+	return fmt.Sprintf("set server %s/%s state %s", backend, server, state)
+}
+
+func SetServerAddrCommand(backend, server, addr string, port int) string {
+	if port > 0 {
+		return fmt.Sprintf("set server %s/%s addr %s port %d", backend, server, addr, port)
+	}
+	return fmt.Sprintf("set server %s/%s addr %s", backend, server, addr)
+}
+
+// Options are server keywords as they'd appear in the config, e.g. "weight", "10", "check"
+func AddServerCommand(backend, server, addr string, options ...string) string {
+	return strings.Join(append([]string{"add", "server", backend + "/" + server, addr}, options...), " ")
+}
+
+func DelServerCommand(backend, server string) string {
+	return fmt.Sprintf("del server %s/%s", backend, server)
+}
+
+func (c *Client) SetWeight(backend, server string, weight int64) error {
+	_, err := c.Execute(SetWeightCommand(backend, server, weight))
+	return err
+}
+
+func (c *Client) SetServerState(backend, server, state string) error {
+	_, err := c.Execute(SetServerStateCommand(backend, server, state))
+	return err
+}
+
+func (c *Client) SetServerAddr(backend, server, addr string, port int) error {
+	_, err := c.Execute(SetServerAddrCommand(backend, server, addr, port))
+	return err
+}
+
+// Add a server at runtime. Needs HAProxy 2.4 or later, and the server has to be enabled with
+// SetServerState before it takes traffic
+func (c *Client) AddServer(backend, server, addr string, options ...string) error {
+	_, err := c.Execute(AddServerCommand(backend, server, addr, options...))
+	return err
+}
+
+// Remove a server at runtime. The server has to be in maintenance with no sessions left
+func (c *Client) DelServer(backend, server string) error {
+	_, err := c.Execute(DelServerCommand(backend, server))
+	return err
+}
+
+// One row of "show stat", keyed by column name (pxname, svname, scur, ...)
+type Stat map[string]string
+
+func (s Stat) Proxy() string {
+	return s["pxname"]
+}
+
+func (s Stat) Server() string {
+	return s["svname"]
+}
+
+// Whether the row is for an actual server rather than a frontend or backend total
+func (s Stat) IsServer() bool {
+	return s.Server() != "FRONTEND" && s.Server() != "BACKEND"
+}
+
+// Numeric value of a column. Empty or missing columns are 0
+func (s Stat) Int(column string) (int64, error) {
+	value := s[column]
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (c *Client) ShowStat() ([]Stat, error) {
+	output, err := c.Execute("show stat")
+	if err != nil {
+		return nil, err
+	}
+
+	// The first line is the header, prefixed with "# "
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(output, "# "))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing stats: %s", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no stats returned")
+	}
+	return parseTable(records[0], records[1:]), nil
+}
+
+// Stats for the servers in one backend
+func (c *Client) ServerStats(backend string) ([]Stat, error) {
+	stats, err := c.ShowStat()
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []Stat
+	for _, stat := range stats {
+		if stat.Proxy() == backend && stat.IsServer() {
+			servers = append(servers, stat)
+		}
+	}
+	return servers, nil
+}
+
+// One row of "show servers state", keyed by column name (be_name, srv_name, srv_addr, ...)
+type ServerState map[string]string
+
+func (s ServerState) Backend() string {
+	return s["be_name"]
+}
+
+func (s ServerState) Name() string {
+	return s["srv_name"]
+}
+
+func (s ServerState) Addr() string {
+	return s["srv_addr"]
+}
+
+// Whether the server is in maintenance, set through the runtime API, by the config or because its
+// address couldn't be resolved
+func (s ServerState) InMaintenance() bool {
+	const forced, config, resolution = 0x01, 0x04, 0x20
+	state, err := strconv.Atoi(s["srv_admin_state"])
+	return err == nil && state&(forced|config|resolution) != 0
+}
+
+// Servers in a backend, or every backend if it's empty
+func (c *Client) ShowServersState(backend string) ([]ServerState, error) {
+	output, err := c.Execute(strings.TrimSpace("show servers state " + backend))
+	if err != nil {
+		return nil, err
+	}
+
+	// The first line is the format version, then a header prefixed with "# "
+	lines := strings.Split(output, "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "# ") {
+		return nil, fmt.Errorf("unexpected servers state output: %s", output)
+	}
+
+	var rows [][]string
+	for _, line := range lines[2:] {
+		rows = append(rows, strings.Fields(line))
+	}
+
+	var states []ServerState
+	for _, row := range parseTable(strings.Fields(strings.TrimPrefix(lines[1], "# ")), rows) {
+		states = append(states, ServerState(row))
+	}
+	return states, nil
+}
+
+func parseTable(header []string, rows [][]string) []Stat {
+	table := make([]Stat, 0, len(rows))
+	for _, row := range rows {
+		stat := make(Stat)
+		for i, column := range header {
+			if i < len(row) {
+				stat[column] = row[i]
+			}
+		}
+		table = append(table, stat)
+	}
+	return table
+}
@@ -0,0 +1,207 @@
+package haproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Runtime API on a UNIX socket that answers each command with a canned response, the way HAProxy
+// does: the output followed by an empty line
+type fakeRuntimeAPI struct {
+	lock      sync.Mutex
+	responses map[string]string
+	received  []string
+}
+
+func startFakeRuntimeAPI(t *testing.T, responses map[string]string) (*fakeRuntimeAPI, *Client, func()) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "haproxy.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	api := &fakeRuntimeAPI{responses: responses}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go api.serve(conn)
+		}
+	}()
+	return api, NewClient("unix://" + socket), func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (a *fakeRuntimeAPI) serve(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	for _, command := range strings.Split(strings.TrimSpace(line), ";") {
+		a.lock.Lock()
+		a.received = append(a.received, command)
+		output, ok := a.responses[command]
+		a.lock.Unlock()
+		if !ok {
+			output = "Unknown command."
+		}
+		if output != "" {
+			output += "\n"
+		}
+		conn.Write([]byte(output + "\n"))
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	_, client, done := startFakeRuntimeAPI(t, map[string]string{
+		"set weight nodes/web-1 50":                    "",
+		"set weight nodes/web-2 50":                    "No such server.",
+		"set weight static/web-1 50":                   "Backend is using a static LB algorithm and only accepts weights '0%' and '100%'.",
+		"set server nodes/web-1 state drain":           "",
+		"set server nodes/web-1 addr 10.0.0.2 port 80": "IP changed from '10.0.0.1' to '10.0.0.2', no need to change the port by 'stats socket command'",
+		"set server nodes/web-2 addr 10.0.0.2 port 80": "No such server.",
+		"add server nodes/web-3 10.0.0.3:80 check":     "New server registered.",
+		"add server nodes/web-1 10.0.0.1:80":           "Already exists a server with the same name in backend.",
+		"del server nodes/web-3":                       "Server deleted.",
+		"del server nodes/web-1":                       "Only servers in maintenance mode can be deleted.",
+	})
+	defer done()
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"set weight", client.SetWeight("nodes", "web-1", 50), false},
+		{"set weight on a missing server", client.SetWeight("nodes", "web-2", 50), true},
+		{"set weight with a static algorithm", client.SetWeight("static", "web-1", 50), true},
+		{"set state", client.SetServerState("nodes", "web-1", "drain"), false},
+		{"set addr", client.SetServerAddr("nodes", "web-1", "10.0.0.2", 80), false},
+		{"set addr on a missing server", client.SetServerAddr("nodes", "web-2", "10.0.0.2", 80), true},
+		{"add server", client.AddServer("nodes", "web-3", "10.0.0.3:80", "check"), false},
+		{"add an existing server", client.AddServer("nodes", "web-1", "10.0.0.1:80"), true},
+		{"del server", client.DelServer("nodes", "web-3"), false},
+		{"del a server in use", client.DelServer("nodes", "web-1"), true},
+	}
+	for _, test := range tests {
+		if _, isCommandError := test.err.(*CommandError); test.wantErr != isCommandError {
+			t.Errorf("%s: error %v, want a command error %t", test.name, test.err, test.wantErr)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	api, client, done := startFakeRuntimeAPI(t, map[string]string{
+		"set weight nodes/web-1 10": "",
+		"set weight nodes/web-2 20": "No such server.",
+		"set weight nodes/web-3 30": "",
+	})
+	defer done()
+
+	responses, err := client.Batch(
+		SetWeightCommand("nodes", "web-1", 10),
+		SetWeightCommand("nodes", "web-2", 20),
+		SetWeightCommand("nodes", "web-3", 30),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("%d responses, want 3", len(responses))
+	}
+	for i, wantErr := range []bool{false, true, false} {
+		if (responses[i].Err != nil) != wantErr {
+			t.Errorf("%s: error %v", responses[i].Command, responses[i].Err)
+		}
+	}
+	api.lock.Lock()
+	if len(api.received) != 3 {
+		t.Errorf("HAProxy received %v, want the 3 commands over one connection", api.received)
+	}
+	api.lock.Unlock()
+
+	if _, err = client.Batch("show stat;show info"); err == nil {
+		t.Error("a command holding a separator was sent")
+	}
+}
+
+func TestShowStat(t *testing.T) {
+	_, client, done := startFakeRuntimeAPI(t, map[string]string{
+		"show stat": "# pxname,svname,scur,weight,\n" +
+			"nodes,FRONTEND,4,,\n" +
+			"nodes,web-1,3,100,\n" +
+			"nodes,web-2,,50,\n" +
+			"nodes,BACKEND,3,150,\n" +
+			"other,api-1,9,100,",
+	})
+	defer done()
+
+	servers, err := client.ServerStats("nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || servers[0].Server() != "web-1" || servers[1].Server() != "web-2" {
+		t.Fatalf("servers %v, want web-1 and web-2", servers)
+	}
+	if sessions, err := servers[0].Int("scur"); err != nil || sessions != 3 {
+		t.Errorf("web-1 has %d sessions (%v), want 3", sessions, err)
+	}
+	if sessions, err := servers[1].Int("scur"); err != nil || sessions != 0 {
+		t.Errorf("web-2 has %d sessions (%v), want 0", sessions, err)
+	}
+}
+
+func TestShowServersState(t *testing.T) {
+	_, client, done := startFakeRuntimeAPI(t, map[string]string{
+		"show servers state nodes": "1\n" +
+			"# be_id be_name srv_id srv_name srv_addr srv_admin_state\n" +
+			"3 nodes 1 web-1 10.0.0.1 0\n" +
+			"3 nodes 2 slot-2 0.0.0.0 5",
+		"show servers state missing": "Can't find backend.",
+	})
+	defer done()
+
+	states, err := client.ShowServersState("nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || states[0].Name() != "web-1" || states[0].Addr() != "10.0.0.1" || states[1].Backend() != "nodes" {
+		t.Errorf("states %v", states)
+	}
+	if states[0].InMaintenance() || !states[1].InMaintenance() {
+		t.Errorf("maintenance %t and %t, want only slot-2 in maintenance", states[0].InMaintenance(), states[1].InMaintenance())
+	}
+
+	if _, err = client.ShowServersState("missing"); err == nil {
+		t.Error("no error for a missing backend")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	for address, want := range map[string]string{
+		"/var/run/haproxy.sock":        "unix:///var/run/haproxy.sock",
+		"unix:///var/run/haproxy.sock": "unix:///var/run/haproxy.sock",
+		"tcp://127.0.0.1:9999":         "tcp://127.0.0.1:9999",
+	} {
+		if got := NewClient(address).String(); got != want {
+			t.Errorf("client for %s is %s, want %s", address, got, want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Package protocol defines the messages exchanged between the master and the worker monitors
+// over the survey socket.
+//
+// The master sends a Survey naming the range of protocol versions it understands, and each worker
+// answers with a Report in the highest version both sides support. Version 0 is the original
+// unversioned format: a literal "CPU" survey answered with "ip,loadavg". Workers in version 1
+// can announce the pool they belong to, for masters managing several pools through one socket.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Newest protocol version implemented by this package
+	Version = 1
+	// Oldest protocol version still understood
+	MinVersion = 0
+
+	// Survey sent by masters that predate versioning
+	LegacySurvey = "CPU"
+
+	// Load average normalized by the number of cores, reported by every version
+	MetricLoadAvg = "loadavg"
+	// Number of cores, reported from version 1 on. The master weights workers by it
+	MetricCores = "cores"
+)
+
+// Survey request sent by the master
+type Survey struct {
+	// Range of versions the master understands
+	Version    int       `json:"version"`
+	MinVersion int       `json:"minVersion"`
+	Time       time.Time `json:"time"`
+}
+
+// Survey response sent by a worker monitor
+type Report struct {
+	Version  int    `json:"version"`
+	WorkerID string `json:"workerID"`
+	// Pool the worker belongs to, when the master manages more than one. It's optional: it was
+	// added to version 1 without a version bump, so masters route reports without it by the
+	// worker's address and older masters ignore it
+	Pool      string             `json:"pool,omitempty"`
+	DropletID int                `json:"dropletID"`
+	Hostname  string             `json:"hostname"`
+	Addr      string             `json:"addr"`
+	Timestamp time.Time          `json:"timestamp"`
+	Metrics   map[string]float64 `json:"metrics"`
+}
+
+func NewSurvey() Survey {
+	return Survey{
+		Version:    Version,
+		MinVersion: MinVersion,
+		Time:       time.Now().UTC(),
+	}
+}
+
+func EncodeSurvey(survey Survey) ([]byte, error) {
+	return json.Marshal(survey)
+}
+
+func DecodeSurvey(msg []byte) (*Survey, error) {
+	if string(msg) == LegacySurvey {
+		return &Survey{}, nil
+	}
+
+	var survey Survey
+	if err := json.Unmarshal(msg, &survey); err != nil {
+		return nil, fmt.Errorf("invalid survey: %s", err)
+	}
+	return &survey, nil
+}
+
+// Pick the version to answer a survey with: the newest one both sides understand
+func Negotiate(survey *Survey) (int, error) {
+	version := Version
+	if survey.Version < version {
+		version = survey.Version
+	}
+	if version < MinVersion || version < survey.MinVersion {
+		return 0, fmt.Errorf("no common protocol version (master speaks %d-%d, worker speaks %d-%d)",
+			survey.MinVersion, survey.Version, MinVersion, Version)
+	}
+	return version, nil
+}
+
+func EncodeReport(report Report, version int) ([]byte, error) {
+	switch version {
+	case 0:
+		return []byte(fmt.Sprintf("%s,%f", report.Addr, report.Metrics[MetricLoadAvg])), nil
+	case 1:
+		report.Version = version
+		return json.Marshal(report)
+	default:
+		return nil, fmt.Errorf("unsupported protocol version %d", version)
+	}
+}
+
+func DecodeReport(msg []byte) (*Report, error) {
+	// Reports from version 1 on are JSON objects
+	if bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+		var report Report
+		if err := json.Unmarshal(msg, &report); err != nil {
+			return nil, fmt.Errorf("invalid report: %s", err)
+		}
+		if report.Version < MinVersion || report.Version > Version {
+			return nil, fmt.Errorf("unsupported protocol version %d", report.Version)
+		}
+		return &report, nil
+	}
+
+	// Otherwise fall back to the original "ip,loadavg" format
+	parts := strings.Split(string(msg), ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid report '%s'", string(msg))
+	}
+	loadAvg, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid load average '%s' from worker '%s'", parts[1], parts[0])
+	}
+
+	return &Report{
+		Version:   0,
+		Addr:      parts[0],
+		Timestamp: time.Now().UTC(),
+		Metrics:   map[string]float64{MetricLoadAvg: loadAvg},
+	}, nil
+}
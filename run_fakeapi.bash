@@ -0,0 +1,15 @@
+#!/usr/bin/env bash
+set -ex
+
+PROG="autoscaler-fakeapi"
+addr=${1:-localhost:8080}
+droplets=$2
+
+cleanup() {
+	rm ${PROG}
+}
+trap cleanup EXIT
+
+go build -o ${PROG} ./fakeapi
+
+./${PROG} -host=${addr} -droplets="${droplets}"